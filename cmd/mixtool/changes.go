@@ -0,0 +1,415 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// mixinOutput is what a mixin evaluates to, to compare versions of it.
+type mixinOutput struct {
+	rules      map[mixer.DataSource][]outputRule
+	dashboards map[string]json.RawMessage
+}
+
+// outputRule is a recording rule or alert of a mixin.
+type outputRule struct {
+	Group  string            `json:"-"`
+	Record string            `json:"record"`
+	Alert  string            `json:"alert"`
+	Expr   string            `json:"expr"`
+	For    string            `json:"for"`
+	Labels map[string]string `json:"labels"`
+}
+
+// evalMixinOutput evaluates the rules, alerts and dashboards of a mixin.
+func evalMixinOutput(e mixer.Evaluator, importPath, config string) (*mixinOutput, error) {
+	out := &mixinOutput{rules: map[mixer.DataSource][]outputRule{}}
+	for _, ds := range []mixer.DataSource{mixer.Prometheus, mixer.Loki} {
+		content, err := e.Exec(mixer.NewRulesAlertsMixin(&mixer.RulesAlertsOptions{
+			DataSource: ds,
+			ImportPath: importPath,
+			Config:     config,
+		}))
+		if err != nil {
+			return nil, err
+		}
+
+		var rules struct {
+			Groups []struct {
+				Name  string       `json:"name"`
+				Rules []outputRule `json:"rules"`
+			} `json:"groups"`
+		}
+		if err := json.Unmarshal(content, &rules); err != nil {
+			return nil, fmt.Errorf("parsing %s rules: %w", ds, err)
+		}
+		for _, g := range rules.Groups {
+			for _, r := range g.Rules {
+				r.Group = g.Name
+				out.rules[ds] = append(out.rules[ds], r)
+			}
+		}
+	}
+
+	content, err := e.Exec(mixer.NewDashboardsMixin(&mixer.DashboardsOptions{ImportPath: importPath, Config: config}))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &out.dashboards); err != nil {
+		return nil, fmt.Errorf("parsing dashboards: %w", err)
+	}
+	return out, nil
+}
+
+// Operations of changes.
+const (
+	changeAdded   = "+"
+	changeRemoved = "-"
+	changeChanged = "~"
+)
+
+// mixinChange is a change of an alert, recording rule or dashboard between
+// two versions of a mixin.
+type mixinChange struct {
+	op   string
+	kind string
+	name string
+	// details describe what changed, one line each.
+	details []string
+}
+
+// compareMixinOutputs returns the changes from old to new, alerts first, then
+// recording rules and dashboards.
+func compareMixinOutputs(old, new *mixinOutput) []mixinChange {
+	var changes []mixinChange
+	for _, ds := range []mixer.DataSource{mixer.Prometheus, mixer.Loki} {
+		prefix := ""
+		if ds == mixer.Loki {
+			prefix = "Loki "
+		}
+		changes = append(changes, compareRules(ds, prefix+"alert", alerts(old.rules[ds]), alerts(new.rules[ds]))...)
+		changes = append(changes, compareRules(ds, prefix+"recording rule", recordingRules(old.rules[ds]), recordingRules(new.rules[ds]))...)
+	}
+
+	for _, name := range sortedKeys(old.dashboards, new.dashboards) {
+		o, inOld := old.dashboards[name]
+		n, inNew := new.dashboards[name]
+		switch {
+		case !inOld:
+			changes = append(changes, mixinChange{op: changeAdded, kind: "dashboard", name: name})
+		case !inNew:
+			changes = append(changes, mixinChange{op: changeRemoved, kind: "dashboard", name: name})
+		case !jsonEqual(o, n):
+			changes = append(changes, mixinChange{op: changeChanged, kind: "dashboard", name: name, details: dashboardChanges(o, n)})
+		}
+	}
+	return changes
+}
+
+// alerts returns the alerts by name. Alerts of the same name, like for
+// different severities, are told apart by their position.
+func alerts(rules []outputRule) map[string]outputRule {
+	return rulesByName(rules, func(r outputRule) string { return r.Alert })
+}
+
+func recordingRules(rules []outputRule) map[string]outputRule {
+	return rulesByName(rules, func(r outputRule) string { return r.Record })
+}
+
+func rulesByName(rules []outputRule, name func(outputRule) string) map[string]outputRule {
+	byName := map[string]outputRule{}
+	seen := map[string]int{}
+	for _, r := range rules {
+		n := name(r)
+		if n == "" {
+			continue
+		}
+		seen[n]++
+		if seen[n] > 1 {
+			n = fmt.Sprintf("%s (%d)", n, seen[n])
+		}
+		byName[n] = r
+	}
+	return byName
+}
+
+func compareRules(ds mixer.DataSource, kind string, old, new map[string]outputRule) []mixinChange {
+	var changes []mixinChange
+	for _, name := range sortedKeys(old, new) {
+		o, inOld := old[name]
+		n, inNew := new[name]
+		switch {
+		case !inOld:
+			changes = append(changes, mixinChange{op: changeAdded, kind: kind, name: name})
+		case !inNew:
+			changes = append(changes, mixinChange{op: changeRemoved, kind: kind, name: name})
+		default:
+			if details := ruleChanges(ds, o, n); len(details) > 0 {
+				changes = append(changes, mixinChange{op: changeChanged, kind: kind, name: name, details: details})
+			}
+		}
+	}
+	return changes
+}
+
+// ruleChanges describes the changes of the expression, for and labels of a
+// rule. Expressions are compared as parsed, so that formatting doesn't count.
+func ruleChanges(ds mixer.DataSource, old, new outputRule) []string {
+	var details []string
+	if o, n := normalizeExpr(ds, old.Expr), normalizeExpr(ds, new.Expr); o != n {
+		details = append(details, "expr:", "  - "+o, "  + "+n)
+	}
+	if old.For != new.For {
+		details = append(details, fmt.Sprintf("for: %s -> %s", orNone(old.For), orNone(new.For)))
+	}
+	if labels := labelChanges(old.Labels, new.Labels); labels != "" {
+		details = append(details, "labels: "+labels)
+	}
+	return details
+}
+
+// normalizeExpr returns a query as formatted by its parser, or as is if it
+// doesn't parse.
+func normalizeExpr(ds mixer.DataSource, expr string) string {
+	if ds == mixer.Loki {
+		if e, err := logql.ParseExpr(expr); err == nil {
+			return e.String()
+		}
+	} else if e, err := parser.ParseExpr(expr); err == nil {
+		return e.String()
+	}
+	return strings.Join(strings.Fields(expr), " ")
+}
+
+func labelChanges(old, new map[string]string) string {
+	var changes []string
+	for _, k := range sortedKeys(old, new) {
+		o, inOld := old[k]
+		n, inNew := new[k]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("+%s=%s", k, n))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("-%s=%s", k, o))
+		case o != n:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", k, o, n))
+		}
+	}
+	return strings.Join(changes, ", ")
+}
+
+// dashboardChanges describes the changes of a dashboard by the titles of its
+// panels, and the settings that changed apart from the panels. Changes of the
+// layout or the IDs of panels are left out.
+func dashboardChanges(old, new json.RawMessage) []string {
+	oldSettings, oldPanels := parseDashboard(old)
+	newSettings, newPanels := parseDashboard(new)
+
+	var details []string
+	var settings []string
+	for _, k := range sortedKeys(oldSettings, newSettings) {
+		if !jsonEqual(oldSettings[k], newSettings[k]) {
+			settings = append(settings, k)
+		}
+	}
+	if len(settings) > 0 {
+		details = append(details, "settings: "+strings.Join(settings, ", "))
+	}
+
+	for _, title := range sortedKeys(oldPanels, newPanels) {
+		o, inOld := oldPanels[title]
+		n, inNew := newPanels[title]
+		switch {
+		case !inOld:
+			details = append(details, "+ panel "+title)
+		case !inNew:
+			details = append(details, "- panel "+title)
+		case !jsonEqual(o.raw, n.raw):
+			details = append(details, "~ panel "+title)
+			for i := 0; i < len(o.exprs) || i < len(n.exprs); i++ {
+				var oe, ne string
+				if i < len(o.exprs) {
+					oe = normalizeExpr(mixer.Prometheus, o.exprs[i])
+				}
+				if i < len(n.exprs) {
+					ne = normalizeExpr(mixer.Prometheus, n.exprs[i])
+				}
+				if oe == ne {
+					continue
+				}
+				details = append(details, "    expr:")
+				if oe != "" {
+					details = append(details, "      - "+oe)
+				}
+				if ne != "" {
+					details = append(details, "      + "+ne)
+				}
+			}
+		}
+	}
+	return details
+}
+
+// dashboardPanel is a panel of a dashboard, with the queries of its targets.
+type dashboardPanel struct {
+	// raw is the panel without its layout, ID and nested panels.
+	raw   json.RawMessage
+	exprs []string
+}
+
+// parseDashboard returns the settings of a dashboard, that is all but its
+// panels, and its panels by title. Panels of rows, both collapsed rows and
+// the rows of old dashboards, count as panels of the dashboard. Panels of the
+// same title are told apart by their position.
+func parseDashboard(content json.RawMessage) (map[string]json.RawMessage, map[string]dashboardPanel) {
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(content, &settings); err != nil {
+		return nil, nil
+	}
+
+	panels := map[string]dashboardPanel{}
+	seen := map[string]int{}
+	var add func(content json.RawMessage)
+	add = func(content json.RawMessage) {
+		var raw []map[string]json.RawMessage
+		var fields []struct {
+			Title   string `json:"title"`
+			Type    string `json:"type"`
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		}
+		if json.Unmarshal(content, &raw) != nil || json.Unmarshal(content, &fields) != nil {
+			return
+		}
+		for i, p := range raw {
+			if nested, ok := p["panels"]; ok {
+				add(nested)
+			}
+			fields := fields[i]
+			if fields.Type == "row" {
+				continue
+			}
+
+			title := fields.Title
+			if title == "" {
+				title = fmt.Sprintf("untitled %s", fields.Type)
+			}
+			seen[title]++
+			if seen[title] > 1 {
+				title = fmt.Sprintf("%s (%d)", title, seen[title])
+			}
+
+			delete(p, "id")
+			delete(p, "gridPos")
+			delete(p, "panels")
+			panel := dashboardPanel{}
+			panel.raw, _ = json.Marshal(p)
+			for _, t := range fields.Targets {
+				panel.exprs = append(panel.exprs, t.Expr)
+			}
+			panels[title] = panel
+		}
+	}
+	add(settings["panels"])
+	var rows []struct {
+		Panels json.RawMessage `json:"panels"`
+	}
+	if err := json.Unmarshal(settings["rows"], &rows); err == nil {
+		for _, r := range rows {
+			add(r.Panels)
+		}
+	}
+
+	for _, k := range []string{"panels", "rows", "id", "version"} {
+		delete(settings, k)
+	}
+	return settings, panels
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var x, y bytes.Buffer
+	if json.Compact(&x, a) != nil || json.Compact(&y, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(x.Bytes(), y.Bytes())
+}
+
+// sortedKeys returns the keys of the maps, which must be map[string]T, sorted
+// and without duplicates.
+func sortedKeys(maps ...interface{}) []string {
+	seen := map[string]bool{}
+	var keys []string
+	add := func(k string) {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	for _, m := range maps {
+		switch m := m.(type) {
+		case map[string]outputRule:
+			for k := range m {
+				add(k)
+			}
+		case map[string]json.RawMessage:
+			for k := range m {
+				add(k)
+			}
+		case map[string]string:
+			for k := range m {
+				add(k)
+			}
+		case map[string]dashboardPanel:
+			for k := range m {
+				add(k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printChanges prints the changes, one per line followed by their details,
+// or that there are none.
+func printChanges(w io.Writer, changes []mixinChange) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "  no changes")
+		return
+	}
+	for _, c := range changes {
+		fmt.Fprintf(w, "  %s %s %s\n", c.op, c.kind, c.name)
+		for _, d := range c.details {
+			fmt.Fprintf(w, "      %s\n", d)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/urfave/cli"
+)
+
+// httpClientFlags are the flags of commands talking to a server, like the
+// mixtool server, configuring the credentials and TLS settings to connect with.
+func httpClientFlags(server string) []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "bearer-token-file",
+			Usage: "File with a bearer token to authenticate to " + server + " with.",
+		},
+		cli.StringFlag{
+			Name:  "basic-auth-username",
+			Usage: "Username to authenticate to " + server + " with.",
+		},
+		cli.StringFlag{
+			Name:  "basic-auth-password-file",
+			Usage: "File with the password to authenticate to " + server + " with.",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca-file",
+			Usage: "CA to verify the certificate of " + server + " with.",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert-file",
+			Usage: "Client certificate to present to " + server + ".",
+		},
+		cli.StringFlag{
+			Name:  "tls-key-file",
+			Usage: "Client key to present to " + server + ".",
+		},
+		cli.BoolFlag{
+			Name:  "tls-insecure-skip-verify",
+			Usage: "Don't verify the certificate of " + server + ".",
+		},
+	}
+}
+
+// newHTTPClient returns an HTTP client configured by the httpClientFlags.
+func newHTTPClient(c *cli.Context) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Bool("tls-insecure-skip-verify")}
+	if caFile := c.String("tls-ca-file"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+	}
+
+	certFile, keyFile := c.String("tls-cert-file"), c.String("tls-key-file")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both a TLS certificate and key file are required")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	rt := &authRoundTripper{next: transport}
+
+	if tokenFile := c.String("bearer-token-file"); tokenFile != "" {
+		token, err := readSecretFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading bearer token: %w", err)
+		}
+		rt.bearerToken = token
+	}
+
+	if rt.username = c.String("basic-auth-username"); rt.username != "" {
+		passwordFile := c.String("basic-auth-password-file")
+		if passwordFile == "" {
+			return nil, fmt.Errorf("basic auth requires a password file")
+		}
+		password, err := readSecretFile(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading basic auth password: %w", err)
+		}
+		rt.password = password
+	}
+
+	return &http.Client{Transport: rt}, nil
+}
+
+// authRoundTripper adds bearer token or basic auth credentials to requests.
+type authRoundTripper struct {
+	next        http.RoundTripper
+	bearerToken string
+	username    string
+	password    string
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.bearerToken == "" && rt.username == "" {
+		return rt.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if rt.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rt.bearerToken)
+	} else {
+		req.SetBasicAuth(rt.username, rt.password)
+	}
+	return rt.next.RoundTrip(req)
+}
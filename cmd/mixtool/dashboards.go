@@ -0,0 +1,374 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/urfave/cli"
+)
+
+func dashboardsCommand() cli.Command {
+	return cli.Command{
+		Name:        "dashboards",
+		Usage:       "Manage the dashboards of a mixin in Grafana",
+		Description: "Manage the dashboards of a mixin in Grafana through its HTTP API",
+		Subcommands: cli.Commands{
+			dashboardsPushCommand(),
+		},
+	}
+}
+
+func dashboardsPushCommand() cli.Command {
+	return cli.Command{
+		Name:        "push",
+		Usage:       "Push the dashboards of a mixin to Grafana",
+		Description: "Create and update the dashboards of a mixin in Grafana, creating the folder if needed. Authenticate with a Grafana API or service account token given as --bearer-token-file, or with basic auth",
+		ArgsUsage:   "<mixin.libsonnet>",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "address",
+				Usage: "Address of Grafana, like http://grafana:3000",
+			},
+			cli.StringFlag{
+				Name:  "folder",
+				Usage: "Title of the folder to push the dashboards into, created if it doesn't exist. Defaults to the General folder",
+			},
+			cli.StringFlag{
+				Name:  "org-id",
+				Usage: "Organization to push the dashboards to, sent as X-Grafana-Org-Id header",
+			},
+			cli.BoolFlag{
+				Name:  "overwrite",
+				Usage: "Update dashboards that already exist in Grafana with the same uid or title. Without it, only new dashboards are created",
+			},
+			cli.StringSliceFlag{
+				Name:  "jpath, J",
+				Usage: "Add folders to be used as vendor folders",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only print the changes that would be made, with a diff of updated dashboards",
+			},
+		}, httpClientFlags("Grafana")...),
+		Action: dashboardsPushAction,
+	}
+}
+
+func dashboardsPushAction(c *cli.Context) error {
+	filename := c.Args().First()
+	if filename == "" {
+		return fmt.Errorf("no jsonnet file given")
+	}
+
+	address := c.String("address")
+	if address == "" {
+		return fmt.Errorf("no Grafana address given")
+	}
+
+	jPath, err := availableVendor(filename, c.StringSlice("jpath"))
+	if err != nil {
+		return err
+	}
+
+	out, err := mixer.NewEvaluator(jPath).Exec(mixer.NewDashboardsMixin(&mixer.DashboardsOptions{ImportPath: filename}))
+	if err != nil {
+		return err
+	}
+	var dashboards map[string]json.RawMessage
+	if err := json.Unmarshal(out, &dashboards); err != nil {
+		return err
+	}
+
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return err
+	}
+
+	grafana := &grafanaClient{
+		client:  client,
+		address: address,
+		orgID:   c.String("org-id"),
+	}
+	return pushDashboards(os.Stdout, grafana, dashboards, c.String("folder"), c.Bool("overwrite"), c.Bool("dry-run"))
+}
+
+// grafanaClient talks to the HTTP API of Grafana.
+type grafanaClient struct {
+	client  *http.Client
+	address string
+	orgID   string
+}
+
+// do sends body as JSON and decodes the response into v, if set. Responses
+// other than 2xx and 404 are returned as error, along with the status code.
+func (c *grafanaClient) do(method, apiPath string, body, v interface{}) (int, error) {
+	u, err := url.Parse(c.address)
+	if err != nil {
+		return 0, err
+	}
+	rel, err := url.Parse(apiPath)
+	if err != nil {
+		return 0, err
+	}
+	u.Path = path.Join(u.Path, rel.Path)
+	u.RawQuery = rel.RawQuery
+
+	var r io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.orgID != "" {
+		req.Header.Set("X-Grafana-Org-Id", c.orgID)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("%s %s: received %s: %s", method, u.Path, resp.Status, bytes.TrimSpace(content))
+	}
+	if v != nil {
+		if err := json.Unmarshal(content, v); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: parsing response: %w", method, u.Path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+type grafanaFolder struct {
+	UID   string `json:"uid"`
+	Title string `json:"title"`
+}
+
+// folderUID returns the uid of the folder with the given title, or false if
+// there is none.
+func (c *grafanaClient) folderUID(title string) (string, bool, error) {
+	var folders []grafanaFolder
+	if _, err := c.do("GET", "/api/folders?limit=1000", nil, &folders); err != nil {
+		return "", false, err
+	}
+	for _, f := range folders {
+		if f.Title == title {
+			return f.UID, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (c *grafanaClient) createFolder(title string) (string, error) {
+	var f grafanaFolder
+	if _, err := c.do("POST", "/api/folders", grafanaFolder{Title: title}, &f); err != nil {
+		return "", err
+	}
+	return f.UID, nil
+}
+
+// grafanaDashboard is a dashboard as returned by the Grafana API.
+type grafanaDashboard struct {
+	Dashboard map[string]interface{} `json:"dashboard"`
+	Meta      struct {
+		FolderUID string `json:"folderUid"`
+	} `json:"meta"`
+}
+
+// dashboard returns the dashboard with the given uid, or nil if there is none.
+func (c *grafanaClient) dashboard(uid string) (*grafanaDashboard, error) {
+	var d grafanaDashboard
+	status, err := c.do("GET", "/api/dashboards/uid/"+url.PathEscape(uid), nil, &d)
+	if err != nil || status == http.StatusNotFound {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// setDashboard creates or updates a dashboard in a folder.
+func (c *grafanaClient) setDashboard(dashboard map[string]interface{}, folderUID string, overwrite bool) error {
+	body := map[string]interface{}{
+		"dashboard": dashboard,
+		"folderUid": folderUID,
+		"overwrite": overwrite,
+		"message":   "Pushed by mixtool",
+	}
+	status, err := c.do("POST", "/api/dashboards/db", body, nil)
+	if status == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w; use --overwrite to replace the dashboard in Grafana", err)
+	}
+	if err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("folder %s not found", folderUID)
+	}
+	return err
+}
+
+// comparableDashboard returns dashboard without the fields Grafana sets on
+// saving, so that pushed and existing dashboards can be compared.
+func comparableDashboard(dashboard map[string]interface{}) map[string]interface{} {
+	d := make(map[string]interface{}, len(dashboard))
+	for k, v := range dashboard {
+		if k != "id" && k != "version" {
+			d[k] = v
+		}
+	}
+	return d
+}
+
+// dashboardDiff returns a unified diff of the dashboards, as indented JSON.
+func dashboardDiff(from, to map[string]interface{}, fromFile, toFile string) (string, error) {
+	var lines [2][]string
+	for i, d := range []map[string]interface{}{from, to} {
+		content, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		lines[i] = difflib.SplitLines(string(content) + "\n")
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        lines[0],
+		B:        lines[1],
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  3,
+	})
+}
+
+// pushDashboards creates and updates the dashboards in the folder with the
+// given title, or the General folder if empty, printing each change to w.
+// Unchanged dashboards are left alone.
+func pushDashboards(w io.Writer, grafana *grafanaClient, dashboards map[string]json.RawMessage, folder string, overwrite, dryRun bool) error {
+	prefix := ""
+	if dryRun {
+		prefix = "would "
+	}
+
+	changes := 0
+	// newFolder is set if the folder is created, so that no dashboard is in
+	// it yet, even if it isn't created in a dry run.
+	newFolder := false
+	folderUID, folderTitle := "", "General"
+	if folder != "" {
+		folderTitle = folder
+		uid, ok, err := grafana.folderUID(folder)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(w, "%screate folder %s\n", prefix, folder)
+			changes++
+			newFolder = true
+			if !dryRun {
+				if uid, err = grafana.createFolder(folder); err != nil {
+					return fmt.Errorf("failed to create folder %s: %w", folder, err)
+				}
+			}
+		}
+		folderUID = uid
+	}
+
+	filenames := make([]string, 0, len(dashboards))
+	for filename := range dashboards {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		var dashboard map[string]interface{}
+		if err := json.Unmarshal(dashboards[filename], &dashboard); err != nil {
+			return fmt.Errorf("dashboard %s: %w", filename, err)
+		}
+		dashboard = comparableDashboard(dashboard)
+		uid, _ := dashboard["uid"].(string)
+		title, _ := dashboard["title"].(string)
+		if title == "" {
+			title = filename
+		}
+
+		var existing *grafanaDashboard
+		if uid != "" {
+			var err error
+			if existing, err = grafana.dashboard(uid); err != nil {
+				return err
+			}
+		}
+
+		action, note := "create", ""
+		var old map[string]interface{}
+		if existing != nil {
+			old = comparableDashboard(existing.Dashboard)
+			if reflect.DeepEqual(old, dashboard) && !newFolder && existing.Meta.FolderUID == folderUID {
+				continue
+			}
+			action = "update"
+			if dryRun && !overwrite {
+				note = " (requires --overwrite)"
+			}
+		}
+
+		fmt.Fprintf(w, "%s%s dashboard %q in folder %s%s\n", prefix, action, title, folderTitle, note)
+		changes++
+		if dryRun {
+			if old != nil {
+				diff, err := dashboardDiff(old, dashboard, "grafana/"+uid, filename)
+				if err != nil {
+					return err
+				}
+				fmt.Fprint(w, diff)
+			}
+			continue
+		}
+		if err := grafana.setDashboard(dashboard, folderUID, overwrite); err != nil {
+			return fmt.Errorf("failed to %s dashboard %q: %w", action, title, err)
+		}
+	}
+
+	if changes == 0 {
+		fmt.Fprintf(w, "dashboards in folder %s are up to date\n", folderTitle)
+	}
+	return nil
+}
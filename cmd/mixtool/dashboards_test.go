@@ -0,0 +1,176 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGrafana is an in-memory stand-in for the folder and dashboard APIs of
+// Grafana, requiring an API token.
+type fakeGrafana struct {
+	mtx        sync.Mutex
+	token      string
+	folders    []grafanaFolder
+	dashboards map[string]*grafanaDashboard
+	requests   []string
+}
+
+func (f *fakeGrafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/folders":
+		json.NewEncoder(w).Encode(f.folders)
+	case r.Method == "POST" && r.URL.Path == "/api/folders":
+		var folder grafanaFolder
+		json.NewDecoder(r.Body).Decode(&folder)
+		folder.UID = fmt.Sprintf("folder-%d", len(f.folders))
+		f.folders = append(f.folders, folder)
+		json.NewEncoder(w).Encode(folder)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/dashboards/uid/"):
+		d, ok := f.dashboards[strings.TrimPrefix(r.URL.Path, "/api/dashboards/uid/")]
+		if !ok {
+			http.Error(w, `{"message":"Dashboard not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+	case r.Method == "POST" && r.URL.Path == "/api/dashboards/db":
+		var req struct {
+			Dashboard map[string]interface{} `json:"dashboard"`
+			FolderUID string                 `json:"folderUid"`
+			Overwrite bool                   `json:"overwrite"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		uid := req.Dashboard["uid"].(string)
+		version := 1.0
+		if existing, ok := f.dashboards[uid]; ok {
+			if !req.Overwrite && req.Dashboard["version"] != existing.Dashboard["version"] {
+				http.Error(w, `{"message":"The dashboard has been changed by someone else","status":"version-mismatch"}`, http.StatusPreconditionFailed)
+				return
+			}
+			version = existing.Dashboard["version"].(float64) + 1
+		}
+		req.Dashboard["id"] = 1
+		req.Dashboard["version"] = version
+		d := &grafanaDashboard{Dashboard: req.Dashboard}
+		d.Meta.FolderUID = req.FolderUID
+		f.dashboards[uid] = d
+		fmt.Fprintf(w, `{"status":"success","uid":%q}`, uid)
+	default:
+		http.Error(w, `{"message":"Not found"}`, http.StatusNotFound)
+	}
+}
+
+func newTestGrafana(t *testing.T) (*fakeGrafana, *grafanaClient) {
+	f := &fakeGrafana{token: "secret", dashboards: map[string]*grafanaDashboard{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, &grafanaClient{
+		client: &http.Client{Transport: &authRoundTripper{
+			next:        http.DefaultTransport,
+			bearerToken: "secret",
+		}},
+		address: srv.URL,
+	}
+}
+
+func testDashboards(panels string) map[string]json.RawMessage {
+	return map[string]json.RawMessage{
+		"a.json": json.RawMessage(`{"uid": "a", "title": "A", "panels": ` + panels + `}`),
+		"b.json": json.RawMessage(`{"uid": "b", "title": "B", "panels": []}`),
+	}
+}
+
+func TestPushDashboards(t *testing.T) {
+	f, grafana := newTestGrafana(t)
+
+	var out bytes.Buffer
+	assert.NoError(t, pushDashboards(&out, grafana, testDashboards("[]"), "Mixins", false, false))
+	assert.Equal(t, `create folder Mixins
+create dashboard "A" in folder Mixins
+create dashboard "B" in folder Mixins
+`, out.String())
+	assert.Len(t, f.dashboards, 2)
+	assert.Equal(t, "folder-0", f.dashboards["a"].Meta.FolderUID)
+
+	// Unchanged dashboards are left alone.
+	out.Reset()
+	f.requests = nil
+	assert.NoError(t, pushDashboards(&out, grafana, testDashboards("[]"), "Mixins", false, false))
+	assert.Equal(t, "dashboards in folder Mixins are up to date\n", out.String())
+	for _, r := range f.requests {
+		assert.NotEqual(t, "POST /api/dashboards/db", r)
+	}
+
+	// Changed dashboards require --overwrite.
+	changed := testDashboards(`[{"title": "Up"}]`)
+	out.Reset()
+	err := pushDashboards(&out, grafana, changed, "Mixins", false, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "--overwrite")
+
+	out.Reset()
+	assert.NoError(t, pushDashboards(&out, grafana, changed, "Mixins", true, false))
+	assert.Equal(t, "update dashboard \"A\" in folder Mixins\n", out.String())
+	assert.Equal(t, 2.0, f.dashboards["a"].Dashboard["version"])
+	assert.Len(t, f.folders, 1)
+}
+
+func TestPushDashboardsDryRun(t *testing.T) {
+	f, grafana := newTestGrafana(t)
+	assert.NoError(t, pushDashboards(&bytes.Buffer{}, grafana, testDashboards("[]"), "", false, false))
+
+	f.requests = nil
+	var out bytes.Buffer
+	assert.NoError(t, pushDashboards(&out, grafana, testDashboards(`[{"title": "Up"}]`), "Mixins", false, true))
+	assert.Equal(t, `would create folder Mixins
+would update dashboard "A" in folder Mixins (requires --overwrite)
+--- grafana/a
++++ a.json
+@@ -1,5 +1,9 @@
+ {
+-  "panels": [],
++  "panels": [
++    {
++      "title": "Up"
++    }
++  ],
+   "title": "A",
+   "uid": "a"
+ }
+would update dashboard "B" in folder Mixins (requires --overwrite)
+`, out.String())
+	for _, r := range f.requests {
+		assert.True(t, strings.HasPrefix(r, "GET "), r)
+	}
+}
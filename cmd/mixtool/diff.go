@@ -0,0 +1,164 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"github.com/urfave/cli"
+)
+
+func diffCommand() cli.Command {
+	return cli.Command{
+		Name:        "diff",
+		Usage:       "Show the changes between two versions of a mixin",
+		Description: "Evaluate two versions of a mixin and print the alerts, recording rules and dashboards that have been added, removed or changed. Expressions are compared as parsed, so changes of formatting don't count, and dashboards are compared by the titles of their panels. With --git-ref, the file is compared to its version at a git ref",
+		ArgsUsage:   "<old> <new> | --git-ref <ref> <file>",
+		Action:      diffAction,
+		Flags: append([]cli.Flag{
+			cli.StringSliceFlag{
+				Name: "jpath, J",
+			},
+			cli.StringFlag{
+				Name:  "git-ref",
+				Usage: "Compare the file to its version at this git ref, like main",
+			},
+		}, evalFlags()...),
+	}
+}
+
+func diffAction(c *cli.Context) error {
+	opts, err := generateOptionsFromFlags(c, "")
+	if err != nil {
+		return err
+	}
+	return diffMixins(os.Stdout, c.Args(), c.StringSlice("jpath"), c.String("git-ref"), opts)
+}
+
+// diffMixins prints the changes between the mixins of two files, or of a
+// file and its version at a git ref.
+func diffMixins(w io.Writer, args []string, jpath []string, ref string, opts generateOptions) error {
+	var oldFile, oldName, newFile string
+	var oldJPath []string
+	var err error
+	if ref != "" {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one jsonnet file to compare to its version at %s", ref)
+		}
+		newFile = args[0]
+
+		var cleanup func()
+		oldFile, cleanup, err = gitCheckout(newFile, ref)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		oldName = ref + ":" + newFile
+	} else {
+		if len(args) != 2 {
+			return fmt.Errorf("expected the old and the new jsonnet file, or one file and --git-ref")
+		}
+		oldFile, newFile = args[0], args[1]
+		oldName = oldFile
+
+		oldJPath, err = availableVendor(oldFile, jpath)
+		if err != nil {
+			return err
+		}
+	}
+
+	newJPath, err := availableVendor(newFile, jpath)
+	if err != nil {
+		return err
+	}
+	// the vendor directory usually isn't checked in, so the version at the
+	// git ref is evaluated with the current one
+	if ref != "" {
+		oldJPath = newJPath
+	}
+
+	old, err := evalMixinOutput(mixer.NewEvaluatorWithExtVars(oldJPath, opts.extVars), oldFile, opts.config)
+	if err != nil {
+		return fmt.Errorf("evaluating %s: %w", oldName, err)
+	}
+	new, err := evalMixinOutput(mixer.NewEvaluatorWithExtVars(newJPath, opts.extVars), newFile, opts.config)
+	if err != nil {
+		return fmt.Errorf("evaluating %s: %w", newFile, err)
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newFile)
+	printChanges(w, compareMixinOutputs(old, new))
+	return nil
+}
+
+// gitCheckout checks out the git repository of file at ref into a temporary
+// worktree and returns the path of file in it, and a function removing the
+// worktree again.
+func gitCheckout(file, ref string) (string, func(), error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", nil, err
+	}
+	// the top level directory of the repository is reported without
+	// symlinks, which file needs to be relative to
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return "", nil, err
+	}
+
+	top, err := gitOutput(filepath.Dir(abs), "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", nil, err
+	}
+	rel, err := filepath.Rel(top, abs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := ioutil.TempDir("", "mixtool-diff")
+	if err != nil {
+		return "", nil, err
+	}
+	worktree := filepath.Join(tmp, filepath.Base(top))
+	if err := git(top, "worktree", "add", "--quiet", "--detach", worktree, ref); err != nil {
+		os.RemoveAll(tmp)
+		return "", nil, err
+	}
+
+	cleanup := func() {
+		git(top, "worktree", "remove", "--force", worktree)
+		os.RemoveAll(tmp)
+	}
+	return filepath.Join(worktree, rel), cleanup, nil
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDiffMixinV1 = `{
+  prometheusAlerts+:: {
+    groups+: [{
+      name: 'example',
+      rules: [{ alert: 'ExampleDown', expr: 'up == 0', 'for': '5m' }],
+    }],
+  },
+  grafanaDashboards+:: {
+    'example.json': {
+      title: 'Example',
+      panels: [
+        { id: 1, title: 'Up', type: 'graph', gridPos: { x: 0 }, targets: [{ expr: 'sum(up)' }] },
+        { id: 2, title: 'Targets', type: 'table', targets: [{ expr: 'up' }] },
+        { id: 3, title: 'Details', type: 'row', collapsed: true, panels: [
+          { id: 4, title: 'Scrape duration', type: 'graph', targets: [{ expr: 'scrape_duration_seconds' }] },
+        ] },
+      ],
+    },
+  },
+}
+`
+
+// testDiffMixinV2 reformats the alert and moves a panel, which don't count,
+// and changes a query, the title and the panels of a collapsed row.
+const testDiffMixinV2 = `{
+  prometheusAlerts+:: {
+    groups+: [{
+      name: 'example',
+      rules: [{ alert: 'ExampleDown', expr: 'up==0', 'for': '5m' }],
+    }],
+  },
+  grafanaDashboards+:: {
+    'example.json': {
+      title: 'Example v2',
+      panels: [
+        { id: 1, title: 'Up', type: 'graph', gridPos: { x: 12 }, targets: [{ expr: 'sum by (job) (up)' }] },
+        { id: 2, title: 'Targets', type: 'table', targets: [{ expr: 'up' }] },
+        { id: 3, title: 'Details', type: 'row', collapsed: true, panels: [
+          { id: 5, title: 'Samples scraped', type: 'graph', targets: [{ expr: 'scrape_samples_scraped' }] },
+        ] },
+      ],
+    },
+  },
+}
+`
+
+const testDiffOutput = `  ~ dashboard example.json
+      settings: title
+      + panel Samples scraped
+      - panel Scrape duration
+      ~ panel Up
+          expr:
+            - sum(up)
+            + sum by(job) (up)
+`
+
+func TestDiffMixins(t *testing.T) {
+	dir := t.TempDir()
+	old := writeFile(t, dir, "old.libsonnet", testDiffMixinV1)
+	new := writeFile(t, dir, "new.libsonnet", testDiffMixinV2)
+
+	var out bytes.Buffer
+	assert.NoError(t, diffMixins(&out, []string{old, new}, nil, "", generateOptions{}))
+	assert.Equal(t, "--- "+old+"\n+++ "+new+"\n"+testDiffOutput, out.String())
+
+	out.Reset()
+	assert.NoError(t, diffMixins(&out, []string{old, old}, nil, "", generateOptions{}))
+	assert.Equal(t, "--- "+old+"\n+++ "+old+"\n  no changes\n", out.String())
+
+	assert.Error(t, diffMixins(&out, []string{old}, nil, "", generateOptions{}))
+}
+
+func TestDiffMixinsGitRef(t *testing.T) {
+	repo := newTestGitRepo(t)
+	gitCommit(t, repo, testDiffMixinV1, "v1")
+	file := writeFile(t, filepath.Join(repo, "example-mixin"), "mixin.libsonnet", testDiffMixinV2)
+
+	var out bytes.Buffer
+	assert.NoError(t, diffMixins(&out, []string{file}, nil, "v1", generateOptions{}))
+	assert.Equal(t, "--- v1:"+file+"\n+++ "+file+"\n"+testDiffOutput, out.String())
+
+	// The worktree of the ref is removed again.
+	worktrees, err := gitOutput(repo, "worktree", "list", "--porcelain")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count([]byte(worktrees), []byte("worktree ")))
+	_, err = os.Stat(file)
+	assert.NoError(t, err)
+}
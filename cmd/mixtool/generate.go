@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/monitoring-mixins/mixtool/pkg/mixer"
 	"github.com/urfave/cli"
@@ -43,6 +44,17 @@ func generateCommand() cli.Command {
 			Value: "out",
 		},
 	}
+	flags = append(flags, evalFlags()...)
+
+	// withPattern returns the flags with a pattern flag, copied so that the
+	// subcommands don't share the backing array of flags
+	withPattern := func(usage, value string) []cli.Flag {
+		return append(append([]cli.Flag{}, flags...), cli.StringFlag{
+			Name:  "pattern, p",
+			Usage: usage,
+			Value: value,
+		})
+	}
 
 	return cli.Command{
 		Name:  "generate",
@@ -51,13 +63,7 @@ func generateCommand() cli.Command {
 			cli.Command{
 				Name:  "alerts",
 				Usage: "Generate Prometheus alerts based on the mixins",
-				Flags: append(flags,
-					cli.StringFlag{
-						Name:  "pattern, p",
-						Usage: "Suffix of the file where Prometheus alerts are written",
-						Value: "alerts",
-					},
-				),
+				Flags: withPattern("Suffix of the file where Prometheus alerts are written", "alerts"),
 				Action: generateAction(func(cfg *GenerateConfig) error {
 					mixed, err := generateRulesAlerts(cfg.RulesAlertsCfgs, mixer.NewAlertsMixin)
 					if err != nil {
@@ -69,13 +75,7 @@ func generateCommand() cli.Command {
 			cli.Command{
 				Name:  "rules",
 				Usage: "Generate Prometheus rules based on the mixins",
-				Flags: append(flags,
-					cli.StringFlag{
-						Name:  "pattern, p",
-						Usage: "Suffix of the file where Prometheus rules are written",
-						Value: "rules",
-					},
-				),
+				Flags: withPattern("Suffix of the file where Prometheus rules are written", "rules"),
 				Action: generateAction(func(cfg *GenerateConfig) error {
 					mixed, err := generateRulesAlerts(cfg.RulesAlertsCfgs, mixer.NewRulesMixin)
 					if err != nil {
@@ -98,13 +98,7 @@ func generateCommand() cli.Command {
 			cli.Command{
 				Name:  "all",
 				Usage: "Generate all resources - alerts, rules, and Grafana dashboards",
-				Flags: append(flags,
-					cli.StringFlag{
-						Name:  "pattern, p",
-						Usage: "Suffix of the file where alerts are written",
-						Value: "rules-alerts",
-					},
-				),
+				Flags: withPattern("Suffix of the file where alerts are written", "rules-alerts"),
 				Action: generateAction(func(cfg *GenerateConfig) error {
 					mixed, err := generateAll(cfg)
 					if err != nil {
@@ -138,6 +132,71 @@ type GenerateConfig struct {
 
 type GenerateAction func(cfg *GenerateConfig) error
 
+// evalFlags are the flags configuring the evaluation of mixins, shared by
+// generate and install.
+func evalFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "ext-str, V",
+			Usage: "Set an external variable as string, as key=value",
+		},
+		cli.StringSliceFlag{
+			Name:  "ext-code",
+			Usage: "Set an external variable as jsonnet code, as key=value",
+		},
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "A jsonnet object merged into the _config of the mixin, like '{ namespace: \"monitoring\" }'",
+		},
+	}
+}
+
+// generateOptions configure the files generated from a mixin.
+type generateOptions struct {
+	dir         string
+	dataSources []string
+	yaml        bool
+	// pattern is the suffix of the files rules and alerts are written to,
+	// or - for stdout.
+	pattern string
+	extVars mixer.ExtVars
+	config  string
+}
+
+// generateOptionsFromFlags returns the generateOptions set by the flags of
+// generate, with the output directory given by dirFlag.
+func generateOptionsFromFlags(c *cli.Context, dirFlag string) (generateOptions, error) {
+	extStr, err := parseKeyValues("ext-str", c.StringSlice("ext-str"))
+	if err != nil {
+		return generateOptions{}, err
+	}
+	extCode, err := parseKeyValues("ext-code", c.StringSlice("ext-code"))
+	if err != nil {
+		return generateOptions{}, err
+	}
+
+	return generateOptions{
+		dir:         c.String(dirFlag),
+		dataSources: c.StringSlice("data-sources"),
+		yaml:        c.BoolT("yaml"),
+		pattern:     c.String("pattern"),
+		extVars:     mixer.ExtVars{Str: extStr, Code: extCode},
+		config:      c.String("config"),
+	}, nil
+}
+
+func parseKeyValues(flag string, values []string) (map[string]string, error) {
+	m := make(map[string]string, len(values))
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("--%s %q: expected key=value", flag, v)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
 func generateAction(generate GenerateAction) cli.ActionFunc {
 	return func(c *cli.Context) error {
 		jPathFlag := c.StringSlice("jpath")
@@ -151,81 +210,92 @@ func generateAction(generate GenerateAction) cli.ActionFunc {
 			return err
 		}
 
-		dataSources := c.StringSlice("data-sources")
-		if len(dataSources) == 0 {
-			dataSources = []string{"loki", "prometheus"}
+		opts, err := generateOptionsFromFlags(c, "directory")
+		if err != nil {
+			return err
 		}
 
-		formatter := mixer.NoFormatter
-		if c.BoolT("yaml") {
-			formatter = mixer.JSONtoYaml
-		}
+		return generate(newGenerateConfig(filename, jPathFlag, opts))
+	}
+}
 
-		directory := c.String("directory")
-		if directory == "" {
-			directory = "out"
-		}
+func newGenerateConfig(filename string, jPath []string, opts generateOptions) *GenerateConfig {
+	dataSources := opts.dataSources
+	if len(dataSources) == 0 {
+		dataSources = []string{"loki", "prometheus"}
+	}
 
-		pattern := c.String("pattern")
-		if pattern == "" || pattern == "-" || pattern == "stdout" {
-			pattern = "/dev/stdout"
+	formatter := mixer.NoFormatter
+	if opts.yaml {
+		formatter = mixer.JSONtoYaml
+	}
+
+	directory := opts.dir
+	if directory == "" {
+		directory = "out"
+	}
+
+	pattern := opts.pattern
+	if pattern == "" || pattern == "-" || pattern == "stdout" {
+		pattern = "/dev/stdout"
+	} else {
+		pattern = "%s-" + pattern
+		if opts.yaml {
+			pattern += ".yml"
 		} else {
-			pattern = "%s-" + pattern
-			if c.BoolT("yaml") {
-				pattern += ".yml"
-			} else {
-				pattern += ".json"
-			}
+			pattern += ".json"
 		}
+	}
 
-		raCfgs := make([]*RulesAlertsConfig, 0)
+	raCfgs := make([]*RulesAlertsConfig, 0)
 
-		for _, dataSource := range dataSources {
-			raCfg := &RulesAlertsConfig{
-				GenOpts: &mixer.GeneratorOptions{
-					Eval: mixer.NewEvaluator(jPathFlag),
-				},
-				Formatter: formatter,
-			}
+	for _, dataSource := range dataSources {
+		raCfg := &RulesAlertsConfig{
+			GenOpts: &mixer.GeneratorOptions{
+				Eval: mixer.NewEvaluatorWithExtVars(jPath, opts.extVars),
+			},
+			Formatter: formatter,
+		}
 
-			switch mixer.DataSource(dataSource) {
-			case mixer.Loki:
-				if pattern != "/dev/stdout" {
-					raCfg.Dst = fmt.Sprintf(pattern, "loki")
-				} else {
-					raCfg.Dst = pattern
-				}
-				raCfg.MixinOpts = &mixer.RulesAlertsOptions{
-					DataSource: mixer.Loki,
-					ImportPath: filename,
-				}
-			case mixer.Prometheus:
-				if pattern != "/dev/stdout" {
-					raCfg.Dst = fmt.Sprintf(pattern, "prom")
-				} else {
-					raCfg.Dst = pattern
-				}
-				raCfg.MixinOpts = &mixer.RulesAlertsOptions{
-					DataSource: mixer.Prometheus,
-					ImportPath: filename,
-				}
-			default:
-				continue
+		switch mixer.DataSource(dataSource) {
+		case mixer.Loki:
+			if pattern != "/dev/stdout" {
+				raCfg.Dst = fmt.Sprintf(pattern, "loki")
+			} else {
+				raCfg.Dst = pattern
+			}
+			raCfg.MixinOpts = &mixer.RulesAlertsOptions{
+				DataSource: mixer.Loki,
+				ImportPath: filename,
+				Config:     opts.config,
 			}
-			raCfgs = append(raCfgs, raCfg)
+		case mixer.Prometheus:
+			if pattern != "/dev/stdout" {
+				raCfg.Dst = fmt.Sprintf(pattern, "prom")
+			} else {
+				raCfg.Dst = pattern
+			}
+			raCfg.MixinOpts = &mixer.RulesAlertsOptions{
+				DataSource: mixer.Prometheus,
+				ImportPath: filename,
+				Config:     opts.config,
+			}
+		default:
+			continue
 		}
+		raCfgs = append(raCfgs, raCfg)
+	}
 
-		return generate(&GenerateConfig{
-			Dir:             directory,
-			RulesAlertsCfgs: raCfgs,
-			DashCfg: &DashboardsConfig{
-				MixinOpts: &mixer.DashboardsOptions{ImportPath: filename},
-				GenOpts: &mixer.GeneratorOptions{
-					Eval: mixer.NewEvaluator(jPathFlag),
-				},
-				Formatter: formatter,
+	return &GenerateConfig{
+		Dir:             directory,
+		RulesAlertsCfgs: raCfgs,
+		DashCfg: &DashboardsConfig{
+			MixinOpts: &mixer.DashboardsOptions{ImportPath: filename, Config: opts.config},
+			GenOpts: &mixer.GeneratorOptions{
+				Eval: mixer.NewEvaluatorWithExtVars(jPath, opts.extVars),
 			},
-		})
+			Formatter: formatter,
+		},
 	}
 }
 
@@ -0,0 +1,38 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestGeneratePatternDefaults(t *testing.T) {
+	defaults := map[string]string{}
+	for _, cmd := range generateCommand().Subcommands {
+		for _, f := range cmd.Flags {
+			if f, ok := f.(cli.StringFlag); ok && f.Name == "pattern, p" {
+				defaults[cmd.Name] = f.Value
+			}
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"alerts": "alerts",
+		"rules":  "rules",
+		"all":    "rules-alerts",
+	}, defaults)
+}
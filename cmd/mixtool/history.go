@@ -0,0 +1,116 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// historyDir is the directory in the rules directory that previous versions
+// of the rule files are kept in, one subdirectory per mixin. Prometheus only
+// loads files with the rule file extension, so it doesn't load the directory,
+// and the Loki ruler doesn't load directories at all.
+const historyDir = ".history"
+
+// errNoHistory is returned by rollback if there is no previous version.
+var errNoHistory = errors.New("no previous version")
+
+func (p *ruleProvisioner) historyDir(name string) string {
+	return filepath.Join(p.rulesDir, historyDir, name)
+}
+
+// versions returns the paths of the previous versions of a mixin's rule file,
+// oldest first.
+func (p *ruleProvisioner) versions(name string) ([]string, error) {
+	entries, err := ioutil.ReadDir(p.historyDir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read history: %w", err)
+	}
+
+	var versions []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ruleFileExt {
+			versions = append(versions, filepath.Join(p.historyDir(name), e.Name()))
+		}
+	}
+	// Versions are named by zero-padded timestamps, so they sort by age.
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// archive keeps the current rule file of a mixin as previous version, keeping
+// at most historySize versions. The last version is kept even if the history
+// is disabled, to restore it if the reload fails. It does nothing if the
+// mixin isn't provisioned.
+func (p *ruleProvisioner) archive(name string) error {
+	keep := p.historySize
+	if keep < 1 {
+		keep = 1
+	}
+
+	content, err := ioutil.ReadFile(p.ruleFile(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read rules file: %w", err)
+	}
+
+	if err := os.MkdirAll(p.historyDir(name), 0755); err != nil {
+		return fmt.Errorf("unable to create history directory: %w", err)
+	}
+	version := filepath.Join(p.historyDir(name), fmt.Sprintf("%020d%s", time.Now().UnixNano(), ruleFileExt))
+	if err := ioutil.WriteFile(version, content, 0644); err != nil {
+		return fmt.Errorf("unable to archive rules file: %w", err)
+	}
+
+	versions, err := p.versions(name)
+	if err != nil {
+		return err
+	}
+	for len(versions) > keep {
+		if err := os.Remove(versions[0]); err != nil {
+			return fmt.Errorf("unable to remove old version: %w", err)
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// rollback restores the latest previous version of a mixin's rule file,
+// removing it from the history. It returns errNoHistory if there is none.
+func (p *ruleProvisioner) rollback(name string) error {
+	versions, err := p.versions(name)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return errNoHistory
+	}
+
+	if err := os.Rename(versions[len(versions)-1], p.ruleFile(name)); err != nil {
+		return fmt.Errorf("cannot restore rules file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rulesVersion(i int) string {
+	return strings.Replace(existingRules, "existing", fmt.Sprintf("version-%d", i), 1)
+}
+
+func TestRuleFileHistory(t *testing.T) {
+	h, ruleFile, _ := newTestRuleProvisioningHandler(t)
+	h.ruleProvisioner.historySize = 2
+
+	for i := 1; i <= 3; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/existing", strings.NewReader(rulesVersion(i))))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	versions, err := h.ruleProvisioner.versions("existing")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	// Rolling back goes back one version at a time, until there are none.
+	for _, expected := range []string{rulesVersion(2), rulesVersion(1)} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/rules/existing/rollback", nil))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		content, err := ioutil.ReadFile(ruleFile)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/rules/existing/rollback", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/rules/existing/rollback", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The history isn't listed as provisioned mixin.
+	files, err := h.ruleProvisioner.list()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestRuleFileRestoreOnReloadFailure(t *testing.T) {
+	// Failed reloads are restored even if the history is disabled.
+	for _, historySize := range []int{2, 0} {
+		t.Run(fmt.Sprintf("history-size=%d", historySize), func(t *testing.T) {
+			testRuleFileRestoreOnReloadFailure(t, historySize)
+		})
+	}
+}
+
+func testRuleFileRestoreOnReloadFailure(t *testing.T, historySize int) {
+	h, ruleFile, _ := newTestRuleProvisioningHandler(t)
+	h.ruleProvisioner.historySize = historySize
+	h.reloader.targets[0].URL = "http://127.0.0.1:0/-/reload"
+
+	// A changed mixin is restored to the previous version.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/existing", strings.NewReader(rulesVersion(1))))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "restored the previous version")
+	content, err := ioutil.ReadFile(ruleFile)
+	assert.NoError(t, err)
+	assert.Equal(t, existingRules, string(content))
+	versions, err := h.ruleProvisioner.versions("existing")
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+
+	// A new mixin is removed again.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/other", strings.NewReader(existingRules)))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	_, err = os.Stat(h.ruleProvisioner.ruleFile("other"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A deleted mixin is restored.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/rules/existing", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	content, err = ioutil.ReadFile(ruleFile)
+	assert.NoError(t, err)
+	assert.Equal(t, existingRules, string(content))
+}
+
+func TestRuleFileHistoryDisabled(t *testing.T) {
+	h, _, _ := newTestRuleProvisioningHandler(t)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/existing", strings.NewReader(rulesVersion(1))))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/rules/existing/rollback", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
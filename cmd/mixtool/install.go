@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
@@ -31,15 +32,17 @@ import (
 	"github.com/monitoring-mixins/mixtool/pkg/mixer"
 
 	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
 )
 
 func installCommand() cli.Command {
 	return cli.Command{
 		Name:        "install",
 		Usage:       "Install a mixin",
-		Description: "Install a mixin from a repository",
+		Description: "Install a mixin by its name in the registries, namespaced by the registry like internal/kafka or looked up by priority, from a repository URL, a local directory or a local git repository given as git+file://REPO[//SUBDIR]. Names, URLs and git+file:// repositories take an optional @REF to install a version",
+		ArgsUsage:   "<[registry/]name[@ref]|url[@ref]|directory|git+file://repo[//subdir][@ref]>",
 		Action:      installAction,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "bind-address",
 				Usage: "Address to bind HTTP server to.",
@@ -53,21 +56,49 @@ func installCommand() cli.Command {
 				Name:  "put, p",
 				Usage: "Specify this flag when you want to send PUT request to mixtool server once the mixins are generated",
 			},
-		},
+			cli.StringFlag{
+				Name:  "output-directory, o",
+				Usage: "The directory where generated outputs are written to",
+				Value: "out",
+			},
+		}, append(append(outputFlags(), registryFlags()...), httpClientFlags("the mixtool server")...)...),
 	}
 }
 
+// outputFlags are the flags of install and update configuring the generated
+// outputs, like those of generate.
+func outputFlags() []cli.Flag {
+	return append([]cli.Flag{
+		cli.BoolTFlag{
+			Name:  "yaml, y",
+			Usage: "Write generated outputs as YAML instead of JSON",
+		},
+		cli.StringSliceFlag{
+			Name:  "data-sources, s",
+			Usage: "The sources used when evaluating rules and alerts (loki,prometheus)",
+		},
+		cli.StringFlag{
+			Name:  "pattern",
+			Usage: "Suffix of the files where rules and alerts are written, or - for stdout",
+			Value: "rules-alerts",
+		},
+	}, evalFlags()...)
+}
+
 // Downloads a mixin from a given repository given by url and places into directory
 // by running jb init and jb install
 func downloadMixin(url string, jsonnetHome string, directory string) error {
-	// intialize the jsonnet bundler library
-	err := jsonnetbundler.InitCommand(directory)
-	if err != nil {
-		return fmt.Errorf("jsonnet bundler init failed %v", err)
+	// intialize the jsonnet bundler library, unless other mixins have been
+	// installed into directory already
+	if _, err := os.Stat(filepath.Join(directory, "jsonnetfile.json")); errors.Is(err, fs.ErrNotExist) {
+		err = jsonnetbundler.InitCommand(directory)
+		if err != nil {
+			return fmt.Errorf("jsonnet bundler init failed %v", err)
+		}
 	}
 
 	// by default, set the single flag to false
-	err = jsonnetbundler.InstallCommand(directory, jsonnetHome, []string{url}, false)
+	err := jsonnetbundler.InstallCommand(directory, jsonnetHome, []string{url}, false)
 	if err != nil {
 		return fmt.Errorf("jsonnet bundler install failed %v", err)
 	}
@@ -75,19 +106,6 @@ func downloadMixin(url string, jsonnetHome string, directory string) error {
 	return nil
 }
 
-// Gets mixins from default website - mostly copied from list.go
-func getMixins() ([]mixin, error) {
-	body, err := queryWebsite(defaultWebsite)
-	if err != nil {
-		return nil, err
-	}
-	mixins, err := parseMixinJSON(body)
-	if err != nil {
-		return nil, err
-	}
-	return mixins, nil
-}
-
 func locateImportFile(jsHome, mixURL string) (string, error) {
 	u, err := url.Parse(mixURL)
 	if err != nil {
@@ -107,7 +125,7 @@ func locateImportFile(jsHome, mixURL string) (string, error) {
 	return importFile, nil
 }
 
-func generateMixin(directory string, jsonnetHome string, mixinURL string, options *GenerateConfig) (map[string]mixer.Mixin, error) {
+func generateMixin(options *GenerateConfig) (map[string]mixer.Mixin, error) {
 	// generate rules, dashboards, alerts
 	mixed, err := generateAll(options)
 	if err != nil {
@@ -121,12 +139,220 @@ func generateMixin(directory string, jsonnetHome string, mixinURL string, option
 	return generateRulesAlerts(options.RulesAlertsCfgs, mixer.NewRulesAlertsMixin)
 }
 
-func putMixin(content []byte, bindAddress string) error {
+// fetchedMixin is a mixin fetched by install, ready to be evaluated.
+type fetchedMixin struct {
+	// name is the name to provision the mixin's rules under.
+	name string
+	// source is what the mixin was fetched from, to fetch it again.
+	source     string
+	importPath string
+	jpath      []string
+}
+
+// gitFileScheme is the scheme of mixins installed from local git
+// repositories, like git+file:///src/repo//path/to/mixin@v1.0.0.
+const gitFileScheme = "git+file://"
+
+// gitDir is the directory that git+file:// mixins are cloned into, outside of
+// the vendor directory as jsonnet-bundler removes everything it doesn't know
+// from it.
+const gitDir = "git"
+
+// fetchMixin fetches the mixin given to install, which is one of:
+//
+//	a local directory                    evaluated in place
+//	git+file://REPO[//SUBDIR][@REF]      cloned from a local git repository
+//	URL[@REF]                            installed with jsonnet-bundler
+//	[REGISTRY/]NAME[@REF]                looked up in the registries by lookup
+//
+// Only names require the registries, so the other sources work offline.
+func fetchMixin(directory, mixinPath string, lookup func(name string) (*mixin, error)) (*fetchedMixin, error) {
+	if strings.HasPrefix(mixinPath, gitFileScheme) {
+		return fetchGitFileMixin(directory, mixinPath)
+	}
+	if fi, err := os.Stat(mixinPath); err == nil && fi.IsDir() {
+		m, err := localMixin(mixinPath)
+		if err != nil {
+			return nil, err
+		}
+		// local directories are fetched again from wherever mixtool runs
+		m.source = filepath.Dir(m.importPath)
+		return m, nil
+	}
+
+	mixinURL, ref := splitRef(mixinPath)
+	name := mixinURL
+	if _, err := url.ParseRequestURI(mixinURL); err == nil {
+		name = strings.TrimSuffix(path.Base(mixinURL), ".git")
+	} else {
+		m, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if mixinURL, err = m.source(); err != nil {
+			return nil, err
+		}
+		name = m.Name
+	}
+
+	uri := mixinURL
+	if ref != "" {
+		uri += "@" + ref
+	}
+
+	// by default jsonnet packages are downloaded under vendor
+	jsonnetHome := "vendor"
+	if err := downloadMixin(uri, jsonnetHome, directory); err != nil {
+		return nil, err
+	}
+
+	importPath, err := locateImportFile(path.Join(directory, jsonnetHome), mixinURL)
+	if err != nil {
+		return nil, err
+	}
+	// the URL is kept, so that the registry isn't needed to update
+	return &fetchedMixin{
+		name:       name,
+		source:     uri,
+		importPath: importPath,
+		jpath:      []string{filepath.Join(directory, jsonnetHome)},
+	}, nil
+}
+
+// splitRef splits the version to install, like @v1.0.0, off a mixin name or
+// URL. An @ followed by a path, like in git@github.com:user/repo.git, isn't a
+// version.
+func splitRef(s string) (string, string) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 || strings.ContainsAny(s[i:], "/:") {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// localMixin returns the mixin in a local directory, installing its
+// dependencies if it has a jsonnetfile.json but no vendor directory yet.
+func localMixin(dir string) (*fetchedMixin, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	importPath := filepath.Join(abs, "mixin.libsonnet")
+	if _, err := os.Stat(importPath); err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(filepath.Join(abs, "jsonnetfile.json"))
+	hasJsonnetfile := err == nil
+	_, err = os.Stat(filepath.Join(abs, "vendor"))
+	if hasJsonnetfile && errors.Is(err, fs.ErrNotExist) {
+		if err := jsonnetbundler.InstallCommand(abs, "vendor", nil, false); err != nil {
+			return nil, fmt.Errorf("jsonnet bundler install failed %v", err)
+		}
+	}
+
+	jpath, err := availableVendor(importPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &fetchedMixin{
+		name:       filepath.Base(abs),
+		importPath: importPath,
+		jpath:      jpath,
+	}, nil
+}
+
+// fetchGitFileMixin clones the repository of a git+file:// mixin into the
+// vendor directory and checks out the given ref, if any.
+func fetchGitFileMixin(directory, mixinPath string) (*fetchedMixin, error) {
+	repo, subdir, ref := splitGitFileMixin(mixinPath)
+	if repo == "" {
+		return nil, fmt.Errorf("no repository given in %s", mixinPath)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(repo), ".git")
+	if subdir != "" {
+		name = filepath.Base(subdir)
+	}
+
+	dst := gitFileClone(directory, mixinPath)
+	if err := os.RemoveAll(dst); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+	if err := git("", "clone", "--quiet", "file://"+repo, dst); err != nil {
+		return nil, err
+	}
+	if ref != "" {
+		if err := git(dst, "checkout", "--quiet", ref); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := localMixin(filepath.Join(dst, subdir))
+	if err != nil {
+		return nil, err
+	}
+	m.name, m.source = name, mixinPath
+	return m, nil
+}
+
+// splitGitFileMixin splits git+file://REPO[//SUBDIR][@REF] into its parts.
+func splitGitFileMixin(mixinPath string) (repo, subdir, ref string) {
+	repo, ref = splitRef(strings.TrimPrefix(mixinPath, gitFileScheme))
+	if i := strings.Index(repo, "//"); i >= 0 {
+		repo, subdir = repo[:i], repo[i+2:]
+	}
+	return repo, subdir, ref
+}
+
+// gitFileClone returns the directory the repository of a git+file:// mixin
+// is cloned into at its ref. Mixins of the same repository and ref share the
+// clone, so that checking out another ref doesn't change installed mixins.
+func gitFileClone(directory, mixinPath string) string {
+	repo, _, ref := splitGitFileMixin(mixinPath)
+	clone := strings.TrimSuffix(filepath.Base(repo), ".git")
+	if ref != "" {
+		clone += "@" + strings.ReplaceAll(ref, "/", "_")
+	}
+	return filepath.Join(directory, gitDir, clone)
+}
+
+func git(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// hasRuleGroups returns whether generated rules contain any rule group.
+func hasRuleGroups(content []byte) (bool, error) {
+	var rules struct {
+		Groups []yaml.Node `yaml:"groups"`
+	}
+	if err := yaml.Unmarshal(content, &rules); err != nil {
+		return false, err
+	}
+	return len(rules.Groups) > 0, nil
+}
+
+// errNotProvisioned is returned by putMixin if the server doesn't serve the
+// API path, like the Loki rules API without --loki-rules-dir.
+var errNotProvisioned = errors.New("not provisioned by the server")
+
+func putMixin(client *http.Client, content []byte, bindAddress string, apiPath string, name string) error {
 	u, err := url.Parse(bindAddress)
 	if err != nil {
 		return err
 	}
-	u.Path = path.Join(u.Path, "/api/v1/rules")
+	u.Path = path.Join(u.Path, apiPath, name)
 
 	r := bytes.NewReader(content)
 	req, err := http.NewRequest("PUT", u.String(), r)
@@ -134,13 +360,18 @@ func putMixin(content []byte, bindAddress string) error {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("response from server %v", err)
 	}
-	if resp.StatusCode == 200 {
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
 		fmt.Println("PUT alerts OK")
-	} else {
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %w", apiPath, errNotProvisioned)
+	default:
 		responseData, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return fmt.Errorf("failed to response body in putMixin, %w", err)
@@ -169,102 +400,89 @@ func installAction(c *cli.Context) error {
 		return fmt.Errorf("Expected the url of mixin repository or name of the mixin. Show available mixins using mixtool list")
 	}
 
-	mixinsList, err := getMixins()
+	registries, err := newRegistries(c)
 	if err != nil {
-		return fmt.Errorf("getMixins failed %v", err)
-	}
-
-	var mixinURL string
-	if _, err := url.ParseRequestURI(mixinPath); err != nil {
-		// check if the name exists in mixinsList
-		found := false
-		for _, m := range mixinsList {
-			if m.Name == mixinPath {
-				// join paths together
-				u, err := url.Parse(m.URL)
-				if err != nil {
-					return fmt.Errorf("url parse failed %v", err)
-				}
-				u.Path = path.Join(u.Path, m.Subdir)
-				mixinURL = u.String()
-				found = true
-				break
-			}
-		}
-		if !found {
-			return fmt.Errorf("Could not find mixin with name %s", mixinPath)
-		}
-	} else {
-		mixinURL = mixinPath
+		return err
 	}
-
-	if mixinURL == "" {
-		return fmt.Errorf("Empty mixinURL")
+	m, err := fetchMixin(directory, mixinPath, registries.lookup)
+	if err != nil {
+		return err
 	}
 
-	// by default jsonnet packages are downloaded under vendor
-	jsonnetHome := "vendor"
-
-	err = downloadMixin(mixinURL, jsonnetHome, directory)
+	ws, err := loadWorkspace(directory)
 	if err != nil {
 		return err
 	}
 
-	importPath, err := locateImportFile(path.Join(directory, jsonnetHome), mixinURL)
+	opts, err := generateOptionsFromFlags(c, "output-directory")
 	if err != nil {
 		return err
 	}
-	deps := []string{importPath}
-
-	generateCfg := &GenerateConfig{
-		Dir: "out",
-		RulesAlertsCfgs: []*RulesAlertsConfig{
-			{
-				Dst: "loki-rules-alerts.yml",
-				MixinOpts: &mixer.RulesAlertsOptions{
-					DataSource: mixer.Loki,
-					ImportPath: importPath,
-				},
-				GenOpts: &mixer.GeneratorOptions{
-					Eval: mixer.NewEvaluator(deps),
-				},
-				Formatter: mixer.JSONtoYaml,
-			},
-			{
-				Dst: "prom-rules-alerts.yml",
-				MixinOpts: &mixer.RulesAlertsOptions{
-					DataSource: mixer.Prometheus,
-					ImportPath: importPath,
-				},
-				GenOpts: &mixer.GeneratorOptions{
-					Eval: mixer.NewEvaluator(deps),
-				},
-				Formatter: mixer.JSONtoYaml,
-			},
-		},
-		DashCfg: &DashboardsConfig{
-			MixinOpts: &mixer.DashboardsOptions{ImportPath: importPath},
-			GenOpts:   &mixer.GeneratorOptions{Eval: mixer.NewEvaluator(deps)},
-			Formatter: mixer.JSONtoYaml,
-		},
+	// each mixin is generated into its own subdirectory, so that mixins
+	// installed into the same directory don't overwrite each other's outputs
+	if opts.dir == "" {
+		opts.dir = "out"
+	}
+	output := filepath.Join(opts.dir, m.name)
+	outputOpts := opts
+	outputOpts.dir = output
+	if _, err := generateMixin(newGenerateConfig(m.importPath, m.jpath, outputOpts)); err != nil {
+		return err
 	}
 
-	rulesAlerts, err := generateMixin(directory, jsonnetHome, mixinURL, generateCfg)
+	err = ws.add(mixinConfig{
+		Name:    m.name,
+		Path:    m.importPath,
+		JPaths:  m.jpath,
+		Source:  m.source,
+		Output:  output,
+		Options: newOutputOptions(opts),
+	})
 	if err != nil {
 		return err
 	}
+	if err := ws.write(); err != nil {
+		return err
+	}
 
 	// check if put address flag was set
 
 	if c.Bool("put") {
 		bindAddress := c.String("bind-address")
-		// run put requests onto the server
-		for _, ra := range rulesAlerts {
-			err = putMixin(ra, bindAddress)
+		client, err := newHTTPClient(c)
+		if err != nil {
+			return err
+		}
+
+		// the server expects YAML rules, however the outputs are written
+		opts.yaml, opts.pattern = true, "rules-alerts"
+		rulesAlerts, err := generateRulesAlerts(newGenerateConfig(m.importPath, m.jpath, opts).RulesAlertsCfgs, mixer.NewRulesAlertsMixin)
+		if err != nil {
+			return err
+		}
+
+		if promRules, ok := rulesAlerts["prom-rules-alerts.yml"]; ok {
+			err = putMixin(client, promRules, bindAddress, "/api/v1/rules", m.name)
 			if err != nil {
 				return err
 			}
 		}
+
+		// only PUT Loki rules if there are any, as the server provisions
+		// them only if configured to, and skip them if it isn't
+		lokiRules := rulesAlerts["loki-rules-alerts.yml"]
+		hasLokiRules, err := hasRuleGroups(lokiRules)
+		if err != nil {
+			return err
+		}
+		if hasLokiRules {
+			err = putMixin(client, lokiRules, bindAddress, "/api/v1/loki/rules", m.name)
+			if errors.Is(err, errNotProvisioned) {
+				fmt.Fprintf(os.Stderr, "skipping the Loki rules of %s: %v\n", m.name, err)
+			} else if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
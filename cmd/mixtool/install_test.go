@@ -17,26 +17,31 @@ package main
 import (
 	"fmt"
 	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/modern-go/concurrent"
 	"github.com/monitoring-mixins/mixtool/pkg/mixer"
 	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
 )
 
 // Try to install every mixin from the mixin repository
 // verify that each package generated has the yaml files
 func TestInstallMixin(t *testing.T) {
-	body, err := queryWebsite(defaultWebsite)
-	if err != nil {
-		t.Errorf("failed to query website %v", err)
+	registries := &registries{
+		config: defaultRegistriesConfig(defaultWebsite),
+		cache:  &registryCache{client: http.DefaultClient},
 	}
-	mixins, err := parseMixinJSON(body)
+	mixins, err := registries.all()
 	if err != nil {
-		t.Errorf("failed to parse mixin body %v", err)
+		t.Errorf("failed to query website %v", err)
 	}
 
 	// download each mixin in turn
@@ -103,7 +108,7 @@ func testInstallMixin(t *testing.T, m mixin) {
 		},
 	}
 
-	_, err = generateMixin(dldir, jsonnetHome, mixinURL, cfg)
+	_, err = generateMixin(cfg)
 	assert.NoError(t, err)
 
 	// verify that alerts, rules, dashboards exist
@@ -141,3 +146,201 @@ func testInstallMixin(t *testing.T, m mixin) {
 
 	// verify that the output of alerts and rules matches using jsonnet
 }
+
+func TestSplitRef(t *testing.T) {
+	for _, tc := range []struct {
+		in, base, ref string
+	}{
+		{"node-exporter", "node-exporter", ""},
+		{"node-exporter@v1.3.0", "node-exporter", "v1.3.0"},
+		{"https://github.com/prometheus/node_exporter/docs/node-mixin@v1.3.0", "https://github.com/prometheus/node_exporter/docs/node-mixin", "v1.3.0"},
+		{"git@github.com:prometheus/node_exporter.git", "git@github.com:prometheus/node_exporter.git", ""},
+	} {
+		base, ref := splitRef(tc.in)
+		assert.Equal(t, tc.base, base, tc.in)
+		assert.Equal(t, tc.ref, ref, tc.in)
+	}
+}
+
+func noRegistry(t *testing.T) func(string) (*mixin, error) {
+	return func(string) (*mixin, error) {
+		t.Fatal("the registry must not be queried")
+		return nil, nil
+	}
+}
+
+func TestFetchLocalMixin(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "example-mixin")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, src, "mixin.libsonnet", testPullMixin)
+
+	m, err := fetchMixin(filepath.Join(dir, "workspace"), src, noRegistry(t))
+	assert.NoError(t, err)
+	assert.Equal(t, "example-mixin", m.name)
+	assert.Equal(t, filepath.Join(src, "mixin.libsonnet"), m.importPath)
+}
+
+// newTestGitRepo creates a git repository with an example-mixin directory.
+func newTestGitRepo(t *testing.T) string {
+	repo := t.TempDir()
+	if err := os.Mkdir(filepath.Join(repo, "example-mixin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := git(repo, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// gitCommit commits content as the example-mixin of repo and tags it.
+func gitCommit(t *testing.T, repo, content, tag string) {
+	writeFile(t, filepath.Join(repo, "example-mixin"), "mixin.libsonnet", content)
+	for _, args := range [][]string{
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", tag},
+		{"tag", tag},
+	} {
+		if err := git(repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFetchGitFileMixin(t *testing.T) {
+	repo := newTestGitRepo(t)
+	gitCommit(t, repo, testPullMixin, "v1")
+	gitCommit(t, repo, strings.Replace(testPullMixin, "'Example'", "'Example v2'", 1), "v2")
+
+	// Fetching the mixin at another ref leaves the one fetched before as is.
+	workspace := t.TempDir()
+	var mixins []*fetchedMixin
+	for _, ref := range []string{"", "@v1"} {
+		m, err := fetchMixin(workspace, gitFileScheme+repo+"//example-mixin"+ref, noRegistry(t))
+		assert.NoError(t, err)
+		assert.Equal(t, "example-mixin", m.name)
+		mixins = append(mixins, m)
+	}
+
+	for i, title := range []string{"Example v2", "Example"} {
+		m := mixins[i]
+		out, err := mixer.NewEvaluator(m.jpath).Exec(mixer.NewDashboardsMixin(&mixer.DashboardsOptions{ImportPath: m.importPath}))
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), `"title": "`+title+`"`)
+	}
+}
+
+func TestInstallOutputOptions(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "example-mixin")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, src, "mixin.libsonnet", `{
+  _config+:: { selector: 'job="default"' },
+  prometheusRules+:: {
+    groups+: [{
+      name: 'example',
+      rules: [{ record: 'job:up:sum', expr: 'sum by (job) (up{%s, cluster="%s"})' % [$._config.selector, std.extVar('cluster')] }],
+    }],
+  },
+}
+`)
+
+	out := filepath.Join(dir, "out")
+	app := cli.NewApp()
+	app.Commands = cli.Commands{installCommand()}
+	err := app.Run([]string{"mixtool", "install",
+		"-d", filepath.Join(dir, "workspace"),
+		"-o", out,
+		"-s", "prometheus",
+		"--yaml=false",
+		"--pattern", "rules",
+		"-V", "cluster=eu-1",
+		"-c", `{ selector: 'job="node"' }`,
+		src,
+	})
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(filepath.Join(out, "example-mixin", "prom-rules.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `up{job=\"node\", cluster=\"eu-1\"}`)
+	_, err = os.Stat(filepath.Join(out, "example-mixin", "loki-rules.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInstallIntoWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a-mixin", "b-mixin"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, name), "mixin.libsonnet", testPullMixin)
+	}
+
+	workspace := filepath.Join(dir, "workspace")
+	out := filepath.Join(dir, "out")
+	app := cli.NewApp()
+	app.Commands = cli.Commands{installCommand()}
+	for _, name := range []string{"a-mixin", "b-mixin", "a-mixin"} {
+		err := app.Run([]string{"mixtool", "install", "-d", workspace, "-o", out, filepath.Join(dir, name)})
+		assert.NoError(t, err)
+	}
+
+	for _, name := range []string{"a-mixin", "b-mixin"} {
+		_, err := os.Stat(filepath.Join(out, name, "prom-rules-alerts.yml"))
+		assert.NoError(t, err)
+	}
+
+	// The workspace file tracks both mixins once, and the server can render
+	// them.
+	c, err := loadMixinsConfig(filepath.Join(workspace, workspaceFile))
+	assert.NoError(t, err)
+	assert.Len(t, c.Mixins, 2)
+	for i, name := range []string{"a-mixin", "b-mixin"} {
+		assert.Equal(t, name, c.Mixins[i].Name)
+		assert.Equal(t, filepath.Join(dir, name, "mixin.libsonnet"), c.Mixins[i].Path)
+		assert.Equal(t, "../out/"+name, c.Mixins[i].Output)
+	}
+}
+
+func TestInstallPutWithoutLoki(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "example-mixin")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, src, "mixin.libsonnet", `{
+  prometheusRules+:: {
+    groups+: [{ name: 'example', rules: [{ record: 'job:up:sum', expr: 'sum by (job) (up)' }] }],
+  },
+  lokiRules+:: {
+    groups+: [{ name: 'example', rules: [{ record: 'job:log_lines:rate5m', expr: 'sum by (job) (rate({job="example"}[5m]))' }] }],
+  },
+}
+`)
+
+	// The server only provisions Prometheus rules, so the Loki rules API
+	// isn't served.
+	h, _, _ := newTestRuleProvisioningHandler(t)
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/rules/", h)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	app := cli.NewApp()
+	app.Commands = cli.Commands{installCommand()}
+	err := app.Run([]string{"mixtool", "install",
+		"-d", filepath.Join(dir, "workspace"),
+		"-o", filepath.Join(dir, "out"),
+		"--put", "--bind-address", srv.URL,
+		src,
+	})
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(h.ruleProvisioner.ruleFile("example-mixin"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "job:up:sum")
+}
@@ -23,10 +23,12 @@ import (
 )
 
 type lintConfig struct {
-	Grafana    bool
-	Loki       bool
-	Prometheus bool
-	Vendor     []string
+	Grafana            bool
+	Loki               bool
+	Prometheus         bool
+	RecordingRules     bool
+	RecordingRuleNames bool
+	Vendor             []string
 }
 
 func lintCommand() cli.Command {
@@ -56,6 +58,16 @@ func lintCommand() cli.Command {
 				Usage:       "Lint Prometheus alerts and rules and their given expressions",
 				Destination: &config.Prometheus,
 			},
+			cli.BoolFlag{
+				Name:        "recording-rules",
+				Usage:       "Cross-check recording rules queried by Grafana dashboards against the ones defined in Prometheus rules, if both are linted",
+				Destination: &config.RecordingRules,
+			},
+			cli.BoolFlag{
+				Name:        "recording-rule-names",
+				Usage:       "Lint the names of Prometheus recording rules against the level:metric:operations convention",
+				Destination: &config.RecordingRuleNames,
+			},
 			cli.StringSliceFlag{
 				Name:  "jpath, J",
 				Usage: "Add folders to be used as vendor folders",
@@ -78,10 +90,12 @@ func lintAction(c *cli.Context) error {
 	}
 
 	options := mixer.LintOptions{
-		JPaths:     jPath,
-		Grafana:    c.BoolT("grafana"),
-		Loki:       c.BoolT("loki"),
-		Prometheus: c.BoolT("prometheus"),
+		JPaths:             jPath,
+		Grafana:            c.BoolT("grafana"),
+		Loki:               c.BoolT("loki"),
+		Prometheus:         c.BoolT("prometheus"),
+		RecordingRules:     c.Bool("recording-rules"),
+		RecordingRuleNames: c.Bool("recording-rule-names"),
 	}
 
 	if err := mixer.Lint(os.Stdout, filename, options); err != nil {
@@ -17,15 +17,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"text/tabwriter"
-	"time"
+	"unicode/utf8"
 
 	"github.com/fatih/color"
 	"github.com/urfave/cli"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
 )
 
 type mixin struct {
@@ -33,6 +37,19 @@ type mixin struct {
 	Description string `json:"description,omitempty"`
 	Name        string `json:"name"`
 	Subdir      string `json:"subdir"`
+	// Registry is the name of the registry the mixin is listed in.
+	Registry string `json:"-"`
+}
+
+// source returns the URL a mixin is installed from, its repository joined
+// with its subdirectory.
+func (m mixin) source() (string, error) {
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		return "", fmt.Errorf("url parse failed %v", err)
+	}
+	u.Path = path.Join(u.Path, m.Subdir)
+	return u.String(), nil
 }
 
 const defaultWebsite = "https://monitoring.mixins.dev/mixins.json"
@@ -41,56 +58,152 @@ func listCommand() cli.Command {
 	return cli.Command{
 		Name:        "list",
 		Usage:       "List all available mixins",
-		Description: "List all available mixins as presented on monitoring.mixins.dev",
+		Description: "List all available mixins as presented on monitoring.mixins.dev, or the configured registries",
 		Action:      listAction,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "path, p",
 				Usage: "provide the path of a url with a json endpoint or a local json file",
 			},
-		},
+			cli.StringFlag{
+				Name:  "search, s",
+				Usage: "Only list mixins whose name or description contains this, ignoring case",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "Print the source, subdirectory, description and whether mixins are installed as wide, json or yaml, instead of only their names",
+			},
+			cli.StringFlag{
+				Name:  "directory, d",
+				Usage: "Path mixins are installed into, to tell which mixins are installed",
+				Value: ".",
+			},
+		}, registryFlags()...),
 	}
 }
 
-func queryWebsite(mixinsWebsite string) ([]byte, error) {
-	client := http.Client{
-		Timeout: time.Second * 10,
+// printMixins prints the names of mixins, namespaced by the name of their
+// registry if namespaced is set.
+func printMixins(mixinsList []mixin, namespaced bool) error {
+	writer := tabwriter.NewWriter(os.Stdout, 4, 8, 0, '\t', tabwriter.TabIndent)
+	fmt.Fprintln(writer, "name")
+	fmt.Fprintln(writer, "----")
+	for _, m := range mixinsList {
+		name := m.Name
+		if namespaced {
+			name = m.Registry + "/" + name
+		}
+		fmt.Fprintf(writer, "%s\n", color.GreenString(name))
 	}
 
-	req, err := http.NewRequest(http.MethodGet, mixinsWebsite, nil)
-	if err != nil {
-		return nil, err
+	return writer.Flush()
+}
+
+// listedMixin is a mixin as printed by list --output json|yaml.
+type listedMixin struct {
+	Name        string `json:"name" yaml:"name"`
+	Registry    string `json:"registry" yaml:"registry"`
+	Source      string `json:"source" yaml:"source"`
+	Subdir      string `json:"subdir,omitempty" yaml:"subdir,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Installed   bool   `json:"installed" yaml:"installed"`
+}
+
+// printMixinsWide prints a table of mixins with a column each for their
+// name, whether they are installed, source, subdirectory and description.
+// Descriptions are wrapped to fit into width, the width of the terminal.
+func printMixinsWide(w io.Writer, mixins []listedMixin, namespaced bool, width int) error {
+	rows := [][]string{{"NAME", "INSTALLED", "SOURCE", "SUBDIR"}}
+	for _, m := range mixins {
+		name := m.Name
+		if namespaced {
+			name = m.Registry + "/" + name
+		}
+		installed := "no"
+		if m.Installed {
+			installed = "yes"
+		}
+		rows = append(rows, []string{name, installed, m.Source, m.Subdir})
 	}
 
-	req.Header.Set("User-Agent", "mixtool-list")
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	indent := 0
+	for _, n := range widths {
+		indent += n + 2
+	}
+	// descriptions are wrapped to fit, but at least into a narrow column
+	descriptionWidth := width - indent
+	if descriptionWidth < 20 {
+		descriptionWidth = 20
 	}
 
-	return body, nil
+	for i, row := range rows {
+		var line strings.Builder
+		for j, cell := range row {
+			padded := cell + strings.Repeat(" ", widths[j]-utf8.RuneCountInString(cell)+2)
+			if j == 0 && i > 0 {
+				padded = color.GreenString(padded)
+			}
+			line.WriteString(padded)
+		}
+
+		description := []string{"DESCRIPTION"}
+		if i > 0 {
+			description = wrap(mixins[i-1].Description, descriptionWidth)
+		}
+		if len(description) == 0 {
+			description = []string{""}
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimRight(line.String()+description[0], " ")); err != nil {
+			return err
+		}
+		for _, d := range description[1:] {
+			if _, err := fmt.Fprintln(w, strings.Repeat(" ", indent)+d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func printMixins(mixinsList []mixin) error {
-	writer := tabwriter.NewWriter(os.Stdout, 4, 8, 0, '\t', tabwriter.TabIndent)
-	fmt.Fprintln(writer, "name")
-	fmt.Fprintln(writer, "----")
-	for _, m := range mixinsList {
-		// for now, do not print out any of the descriptions
-		// m.Description = strings.Replace(m.Description, "\n", "", -1)
-		// // maybe truncate the description if it's too long
-		// if len(m.Description) <= 0 {
-		// 	m.Description = "N/A"
-		// }
-		fmt.Fprintf(writer, "%s\n", color.GreenString(m.Name))
+// wrap splits text into lines of at most width characters, breaking at
+// whitespace. Words longer than width get a line of their own.
+func wrap(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
 	}
+	return lines
+}
 
-	return writer.Flush()
+// terminalWidth returns the width of the terminal, $COLUMNS if stdout isn't
+// one, or 80.
+func terminalWidth() int {
+	if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 {
+		return width
+	}
+	if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 0 {
+		return width
+	}
+	return 80
 }
 
 // ParsesMixinJSON expects a top level key mixins which contains a list of mixins
@@ -103,52 +216,103 @@ func parseMixinJSON(body []byte) ([]mixin, error) {
 	return mixinsList, nil
 }
 
-// if path is not specified, default to the mixins website
-// otherwise, try parse as url
-// otherwise, try look for a local json file
+// if path is not specified, list the mixins of the configured registries
+// otherwise, list the mixins of the url or local json file
 func listAction(c *cli.Context) error {
-	path := c.String("path")
-	var body []byte
-	var err error
-	if path == "" {
-		body, err = queryWebsite(defaultWebsite)
-		if err != nil {
-			return err
-		}
-		mixins, err := parseMixinJSON(body)
-		if err != nil {
-			return err
-		}
-		return printMixins(mixins)
+	output := c.String("output")
+	switch output {
+	case "", "wide", "json", "yaml":
+	default:
+		return fmt.Errorf("unknown output %q, expected wide, json or yaml", output)
 	}
 
-	_, err = url.ParseRequestURI(path)
+	r, err := newRegistries(c)
 	if err != nil {
-		// check if it's a local json file
-		_, err = os.Stat(path)
-		if err != nil {
-			return err
-		}
-		body, err = ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		mixins, err := parseMixinJSON(body)
-		if err != nil {
-			return err
-		}
-		return printMixins(mixins)
+		return err
+	}
+	if path := c.String("path"); path != "" {
+		r.config = defaultRegistriesConfig(path)
 	}
 
-	body, err = queryWebsite(path)
+	mixins, err := r.all()
 	if err != nil {
 		return err
 	}
+	mixins = searchMixins(mixins, c.String("search"))
+	namespaced := len(r.config.Registries) > 1
+	if output == "" {
+		return printMixins(mixins, namespaced)
+	}
 
-	mixins, err := parseMixinJSON(body)
+	ws, err := loadWorkspace(c.String("directory"))
+	if err != nil {
+		return err
+	}
+	listed, err := listMixins(mixins, ws)
 	if err != nil {
 		return err
 	}
-  
-	return printMixins(mixins)
+
+	switch output {
+	case "wide":
+		return printMixinsWide(os.Stdout, listed, namespaced, terminalWidth())
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(listed)
+	default:
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(listed); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+}
+
+// searchMixins returns the mixins whose name, namespaced or not, or
+// description contains search, ignoring case.
+func searchMixins(mixins []mixin, search string) []mixin {
+	if search == "" {
+		return mixins
+	}
+	search = strings.ToLower(search)
+
+	var found []mixin
+	for _, m := range mixins {
+		for _, s := range []string{m.Registry + "/" + m.Name, m.Description} {
+			if strings.Contains(strings.ToLower(s), search) {
+				found = append(found, m)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// listMixins returns the mixins to print, telling mixins installed into a
+// workspace by their source.
+func listMixins(mixins []mixin, ws *workspace) ([]listedMixin, error) {
+	installed := map[string]bool{}
+	for _, m := range ws.config.Mixins {
+		source, _ := splitRef(m.Source)
+		installed[source] = true
+	}
+
+	listed := make([]listedMixin, 0, len(mixins))
+	for _, m := range mixins {
+		source, err := m.source()
+		if err != nil {
+			return nil, fmt.Errorf("mixin %s: %w", m.Name, err)
+		}
+		listed = append(listed, listedMixin{
+			Name:        m.Name,
+			Registry:    m.Registry,
+			Source:      m.URL,
+			Subdir:      m.Subdir,
+			Description: strings.TrimSpace(m.Description),
+			Installed:   installed[source],
+		})
+	}
+	return listed, nil
 }
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -67,3 +68,60 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestSearchMixins(t *testing.T) {
+	mixins, err := parseMixinJSON([]byte(exampleMixins))
+	assert.NoError(t, err)
+	for i := range mixins {
+		mixins[i].Registry = defaultRegistry
+	}
+
+	for search, names := range map[string][]string{
+		"":                 {"ceph", "cortex", "cool-mixin"},
+		"CORTEX":           {"cortex"},
+		"fantastic":        {"cool-mixin"},
+		"default/co":       {"cortex", "cool-mixin"},
+		"prometheus alert": {"ceph"},
+		"kafka":            nil,
+	} {
+		var found []string
+		for _, m := range searchMixins(mixins, search) {
+			found = append(found, m.Name)
+		}
+		assert.Equal(t, names, found, search)
+	}
+}
+
+func TestListMixinsWide(t *testing.T) {
+	mixins, err := parseMixinJSON([]byte(exampleMixins))
+	assert.NoError(t, err)
+	for i := range mixins {
+		mixins[i].Registry = defaultRegistry
+	}
+
+	ws := &workspace{config: &mixinsConfig{Mixins: []mixinConfig{
+		{Name: "cortex-mixin", Source: "https://github.com/grafana/cortex-jsonnet/cortex-mixin@main"},
+	}}}
+	listed, err := listMixins(mixins, ws)
+	assert.NoError(t, err)
+	assert.Equal(t, listedMixin{
+		Name:      "cortex",
+		Registry:  defaultRegistry,
+		Source:    "https://github.com/grafana/cortex-jsonnet",
+		Subdir:    "cortex-mixin",
+		Installed: true,
+	}, listed[1])
+	assert.False(t, listed[0].Installed)
+
+	var out bytes.Buffer
+	assert.NoError(t, printMixinsWide(&out, listed, false, 110))
+	assert.Equal(t, `NAME        INSTALLED  SOURCE                                     SUBDIR        DESCRIPTION
+ceph        no         https://github.com/ceph/ceph-mixins                      A set of Prometheus alerts for
+                                                                                Ceph. The scope of this
+                                                                                project is to provide Ceph
+                                                                                specific Prometheus rule files
+                                                                                using Prometheus Mixins.
+cortex      yes        https://github.com/grafana/cortex-jsonnet  cortex-mixin
+cool-mixin  no         https://github.com                         cool-mixin    A fantastic mixin
+`, out.String())
+}
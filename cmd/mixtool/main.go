@@ -37,10 +37,16 @@ func main() {
 	app.Commands = cli.Commands{
 		generateCommand(),
 		lintCommand(),
+		testCommand(),
+		rulesCommand(),
+		dashboardsCommand(),
 		newCommand(),
 		serverCommand(),
 		listCommand(),
 		installCommand(),
+		updateCommand(),
+		uninstallCommand(),
+		diffCommand(),
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -0,0 +1,158 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of provisioning requests.
+const (
+	outcomeProvisioned  = "provisioned"
+	outcomeUnchanged    = "unchanged"
+	outcomeInvalid      = "invalid"
+	outcomeError        = "error"
+	outcomeReloadFailed = "reload_failed"
+)
+
+// serverMetrics are the metrics of the server, labelled by artifact kind.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	provisionRequests *prometheus.CounterVec
+	reloads           *prometheus.CounterVec
+	reloadFailures    *prometheus.CounterVec
+	lastProvision     *prometheus.GaugeVec
+	ruleFileBytes     *prometheus.GaugeVec
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		provisionRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mixtool_server_provision_requests_total",
+			Help: "Total number of provisioning requests by artifact kind, method and outcome.",
+		}, []string{"kind", "method", "outcome"}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mixtool_server_reloads_total",
+			Help: "Total number of reloads triggered after provisioning, by artifact kind.",
+		}, []string{"kind"}),
+		reloadFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mixtool_server_reload_failures_total",
+			Help: "Total number of failed reloads, by artifact kind.",
+		}, []string{"kind"}),
+		lastProvision: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mixtool_server_last_successful_provision_timestamp_seconds",
+			Help: "Timestamp of the last successful provisioning, including the reload, by artifact kind.",
+		}, []string{"kind"}),
+		ruleFileBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mixtool_server_rule_file_bytes",
+			Help: "Size of the provisioned files, by artifact kind and mixin.",
+		}, []string{"kind", "mixin"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.provisionRequests,
+		m.reloads,
+		m.reloadFailures,
+		m.lastProvision,
+		m.ruleFileBytes,
+	)
+	return m
+}
+
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// init initializes the metrics of an artifact kind from the files already
+// provisioned.
+func (m *serverMetrics) init(kind string, p *ruleProvisioner) error {
+	if m == nil {
+		return nil
+	}
+	m.reloads.WithLabelValues(kind)
+	m.reloadFailures.WithLabelValues(kind)
+
+	files, err := p.list()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		m.setRuleFileBytes(kind, f.Mixin, f.File)
+	}
+	return nil
+}
+
+func (m *serverMetrics) provisionRequest(kind, method, outcome string) {
+	if m == nil {
+		return
+	}
+	m.provisionRequests.WithLabelValues(kind, method, outcome).Inc()
+	if outcome == outcomeProvisioned {
+		m.lastProvision.WithLabelValues(kind).SetToCurrentTime()
+	}
+}
+
+func (m *serverMetrics) reloaded(kind string, err error) {
+	if m == nil {
+		return
+	}
+	m.reloads.WithLabelValues(kind).Inc()
+	if err != nil {
+		m.reloadFailures.WithLabelValues(kind).Inc()
+	}
+}
+
+// setRuleFileBytes sets the size of the file of a mixin, removing the metric
+// if the file doesn't exist.
+func (m *serverMetrics) setRuleFileBytes(kind, mixin, file string) {
+	if m == nil {
+		return
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		m.ruleFileBytes.DeleteLabelValues(kind, mixin)
+		return
+	}
+	m.ruleFileBytes.WithLabelValues(kind, mixin).Set(float64(fi.Size()))
+}
+
+// healthyHandler serves /-/healthy, reporting the server as healthy as long
+// as it serves requests.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "mixtool server is Healthy.")
+}
+
+// readyHandler serves /-/ready, reporting the server as ready if the
+// directories of all artifact kinds are accessible.
+func readyHandler(kinds []*artifactKind) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, k := range kinds {
+			if _, err := os.Stat(k.dir); err != nil {
+				http.Error(w, fmt.Sprintf("mixtool server is not ready: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "mixtool server is Ready.")
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMetrics(t *testing.T) {
+	h, ruleFile, _ := newTestRuleProvisioningHandler(t)
+	h.kind = "prometheus"
+	h.metrics = newServerMetrics()
+	m := h.metrics
+	assert.NoError(t, m.init(h.kind, h.ruleProvisioner))
+	assert.Equal(t, float64(len(existingRules)), testutil.ToFloat64(m.ruleFileBytes.WithLabelValues("prometheus", "existing")))
+
+	put := func(name, rules string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/"+name, strings.NewReader(rules)))
+	}
+	put("other", existingRules)
+	put("other", existingRules)
+	put("other", "not: [yaml")
+
+	h.reloader.targets[0].URL = "http://127.0.0.1:0/-/reload"
+	put("other", strings.Replace(existingRules, "existing", "changed", 1))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/rules/existing", nil))
+
+	for outcome, expected := range map[string]float64{
+		outcomeProvisioned:  1,
+		outcomeUnchanged:    1,
+		outcomeInvalid:      1,
+		outcomeReloadFailed: 1,
+	} {
+		assert.Equal(t, expected, testutil.ToFloat64(m.provisionRequests.WithLabelValues("prometheus", "PUT", outcome)), outcome)
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.provisionRequests.WithLabelValues("prometheus", "DELETE", outcomeReloadFailed)))
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.reloads.WithLabelValues("prometheus")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.reloadFailures.WithLabelValues("prometheus")))
+	assert.NotZero(t, testutil.ToFloat64(m.lastProvision.WithLabelValues("prometheus")))
+
+	fi, err := os.Stat(filepath.Join(filepath.Dir(ruleFile), "other.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(fi.Size()), testutil.ToFloat64(m.ruleFileBytes.WithLabelValues("prometheus", "other")))
+	// The mixin whose deletion failed to reload is restored, with its metric.
+	assert.Equal(t, 2, testutil.CollectAndCount(m.ruleFileBytes))
+	assert.Equal(t, float64(len(existingRules)), testutil.ToFloat64(m.ruleFileBytes.WithLabelValues("prometheus", "existing")))
+
+	w = httptest.NewRecorder()
+	m.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "mixtool_server_provision_requests_total")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthyHandler(w, httptest.NewRequest("GET", "/-/healthy", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	dir := t.TempDir()
+	ready := readyHandler([]*artifactKind{{name: "prometheus", dir: dir}})
+	w = httptest.NewRecorder()
+	ready.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.NoError(t, os.Remove(dir))
+	w = httptest.NewRecorder()
+	ready.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
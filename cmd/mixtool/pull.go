@@ -0,0 +1,325 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"gopkg.in/yaml.v3"
+)
+
+// syncMethod is the method label of the metrics of provisioning done by the
+// server itself in pull mode.
+const syncMethod = "SYNC"
+
+// mixinsConfig configures the mixins the server renders and provisions itself
+// in pull mode:
+//
+//	mixins:
+//	  - name: node-exporter
+//	    path: node-mixin/mixin.libsonnet
+//	    jpaths: [node-mixin/vendor]
+//
+// Relative paths are resolved against the directory of the file. Without
+// jpaths, the vendor directory next to the mixin's jsonnetfile.json is used.
+type mixinsConfig struct {
+	Mixins []mixinConfig `yaml:"mixins"`
+}
+
+type mixinConfig struct {
+	Name   string   `yaml:"name"`
+	Path   string   `yaml:"path"`
+	JPaths []string `yaml:"jpaths,omitempty"`
+	// Source, Output and Options are set for mixins installed into a
+	// workspace, see workspace.go. The server ignores Source and Output, and
+	// renders the mixin with the external variables and config of Options.
+	Source  string         `yaml:"source,omitempty"`
+	Output  string         `yaml:"output,omitempty"`
+	Options *outputOptions `yaml:"options,omitempty"`
+}
+
+// readMixinsConfig reads a mixins configuration as is.
+func readMixinsConfig(filename string) (*mixinsConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var c mixinsConfig
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing mixins config %s: %w", filename, err)
+	}
+	return &c, nil
+}
+
+// loadMixinsConfig reads and validates a mixins configuration, resolving the
+// paths of the mixins.
+func loadMixinsConfig(filename string) (*mixinsConfig, error) {
+	c, err := readMixinsConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(filename)
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	names := map[string]bool{}
+	for i := range c.Mixins {
+		m := &c.Mixins[i]
+		if !validMixinName.MatchString(m.Name) {
+			return nil, fmt.Errorf("mixin %d: invalid name %q", i, m.Name)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("mixin %s: duplicate name", m.Name)
+		}
+		names[m.Name] = true
+		if m.Path == "" {
+			return nil, fmt.Errorf("mixin %s: no path given", m.Name)
+		}
+
+		m.Path = resolve(m.Path)
+		for j := range m.JPaths {
+			m.JPaths[j] = resolve(m.JPaths[j])
+		}
+		if m.JPaths, err = availableVendor(m.Path, m.JPaths); err != nil {
+			return nil, fmt.Errorf("mixin %s: %w", m.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// mixinSyncer renders the configured mixins and provisions their rules
+// through the handlers of the server, and their dashboards into a directory
+// for Grafana's file provisioning.
+type mixinSyncer struct {
+	configFile string
+	// handlers are the handlers of the provisioned artifact kinds by name.
+	handlers      map[string]*ruleProvisioningHandler
+	dashboardsDir string
+
+	mtx sync.Mutex
+	// synced are the mixins provisioned by previous syncs, to remove them
+	// once they are no longer configured.
+	synced map[string]bool
+}
+
+// run syncs right away and then every interval until ctx is done.
+func (s *mixinSyncer) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, err := range s.sync(ctx) {
+			log.Printf("sync: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync re-reads the configuration, renders and provisions all mixins and
+// removes those no longer configured. It returns the errors of all mixins.
+func (s *mixinSyncer) sync(ctx context.Context) []error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := loadMixinsConfig(s.configFile)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	configured := map[string]bool{}
+	for _, m := range c.Mixins {
+		configured[m.Name] = true
+		if err := s.syncMixin(ctx, m); err != nil {
+			errs = append(errs, fmt.Errorf("mixin %s: %w", m.Name, err))
+		}
+		if s.synced == nil {
+			s.synced = map[string]bool{}
+		}
+		s.synced[m.Name] = true
+	}
+
+	var removed []string
+	for name := range s.synced {
+		if !configured[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		if err := s.removeMixin(ctx, name); err != nil {
+			errs = append(errs, fmt.Errorf("mixin %s: %w", name, err))
+			continue
+		}
+		delete(s.synced, name)
+	}
+	return errs
+}
+
+func (s *mixinSyncer) syncMixin(ctx context.Context, m mixinConfig) error {
+	opts := m.generateOptions()
+	e := mixer.NewEvaluatorWithExtVars(m.JPaths, opts.extVars)
+
+	for _, kind := range []mixer.DataSource{mixer.Prometheus, mixer.Loki} {
+		h, ok := s.handlers[string(kind)]
+		if !ok {
+			continue
+		}
+
+		out, err := e.Exec(mixer.NewRulesAlertsMixin(&mixer.RulesAlertsOptions{DataSource: kind, ImportPath: m.Path, Config: opts.config}))
+		if err != nil {
+			return err
+		}
+		rules, err := mixer.JSONtoYaml(out)
+		if err != nil {
+			return err
+		}
+
+		// Most mixins don't have Loki rules, so don't provision empty ones.
+		if kind == mixer.Loki {
+			hasRules, err := hasRuleGroups(rules)
+			if err != nil {
+				return err
+			}
+			if !hasRules {
+				continue
+			}
+		}
+
+		h.mtx.Lock()
+		err = h.provisionMixin(ctx, syncMethod, m.Name, bytes.NewReader(rules))
+		h.mtx.Unlock()
+		if err != nil {
+			return fmt.Errorf("provisioning %s rules: %w", kind, err)
+		}
+	}
+
+	if s.dashboardsDir == "" {
+		return nil
+	}
+	out, err := e.Exec(mixer.NewDashboardsMixin(&mixer.DashboardsOptions{ImportPath: m.Path, Config: opts.config}))
+	if err != nil {
+		return err
+	}
+	var dashboards map[string]json.RawMessage
+	if err := json.Unmarshal(out, &dashboards); err != nil {
+		return err
+	}
+	return writeDashboards(filepath.Join(s.dashboardsDir, m.Name), dashboards)
+}
+
+func (s *mixinSyncer) removeMixin(ctx context.Context, name string) error {
+	for _, h := range s.handlers {
+		h.mtx.Lock()
+		err := h.removeMixin(ctx, syncMethod, name)
+		h.mtx.Unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if s.dashboardsDir != "" {
+		return os.RemoveAll(filepath.Join(s.dashboardsDir, name))
+	}
+	return nil
+}
+
+// writeDashboards writes the dashboards into dir, only touching changed files,
+// and removes the dashboards that no longer exist.
+func writeDashboards(dir string, dashboards map[string]json.RawMessage) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for filename, dashboard := range dashboards {
+		if filepath.Base(filename) != filename {
+			return fmt.Errorf("invalid dashboard file name %q", filename)
+		}
+
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, dashboard, "", "  "); err != nil {
+			return fmt.Errorf("dashboard %s: %w", filename, err)
+		}
+		buf.WriteByte('\n')
+
+		path := filepath.Join(dir, filename)
+		if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, buf.Bytes()) {
+			continue
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, ok := dashboards[e.Name()]; !ok && !e.IsDir() {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves POST /api/v1/sync, a webhook to sync right away, like
+// after pushing changes to the mixins.
+func (s *mixinSyncer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad request: only POST requests supported", http.StatusBadRequest)
+		return
+	}
+
+	errs := s.sync(r.Context())
+	if len(errs) == 0 {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+
+	resp := struct {
+		Errors []string `json:"errors"`
+	}{}
+	for _, err := range errs {
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	writeJSON(w, http.StatusInternalServerError, resp)
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPullMixin = `{
+  prometheusRules+:: {
+    groups+: [{
+      name: 'example',
+      rules: [{ record: 'job:up:sum', expr: 'sum by (job) (up)' }],
+    }],
+  },
+  grafanaDashboards+:: {
+    'example.json': { title: 'Example', panels: [] },
+  },
+}
+`
+
+func TestLoadMixinsConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := loadMixinsConfig(writeFile(t, dir, "mixins.yaml", `mixins:
+- name: example
+  path: example/mixin.libsonnet
+  jpaths: [vendor]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []mixinConfig{{
+		Name:   "example",
+		Path:   filepath.Join(dir, "example/mixin.libsonnet"),
+		JPaths: []string{filepath.Join(dir, "vendor")},
+	}}, c.Mixins)
+
+	for _, content := range []string{
+		"mixins:\n- name: ../example\n  path: mixin.libsonnet\n",
+		"mixins:\n- name: example\n  path: a.libsonnet\n- name: example\n  path: b.libsonnet\n",
+		"mixins:\n- name: example\n",
+		"mixins:\n- name: example\n  path: mixin.libsonnet\n  unknown: true\n",
+	} {
+		_, err := loadMixinsConfig(writeFile(t, dir, "mixins.yaml", content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestMixinSyncer(t *testing.T) {
+	h, _, reloads := newTestRuleProvisioningHandler(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "mixin.libsonnet", testPullMixin)
+	configFile := writeFile(t, dir, "mixins.yaml", "mixins:\n- name: example\n  path: mixin.libsonnet\n")
+	dashboardsDir := filepath.Join(dir, "dashboards")
+
+	s := &mixinSyncer{
+		configFile:    configFile,
+		handlers:      map[string]*ruleProvisioningHandler{"prometheus": h},
+		dashboardsDir: dashboardsDir,
+	}
+
+	assert.Empty(t, s.sync(context.Background()))
+	assert.Equal(t, 1, *reloads)
+	rules, err := ioutil.ReadFile(h.ruleProvisioner.ruleFile("example"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(rules), "job:up:sum")
+	dashboard, err := ioutil.ReadFile(filepath.Join(dashboardsDir, "example", "example.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(dashboard), `"title": "Example"`)
+
+	// Unchanged mixins are not reloaded.
+	assert.Empty(t, s.sync(context.Background()))
+	assert.Equal(t, 1, *reloads)
+
+	// Changed mixins are, and stale dashboards are removed.
+	writeFile(t, dir, "mixin.libsonnet", strings.NewReplacer("(up)", "(up{job!=\"\"})", "example.json", "other.json").Replace(testPullMixin))
+	assert.Empty(t, s.sync(context.Background()))
+	assert.Equal(t, 2, *reloads)
+	_, err = os.Stat(filepath.Join(dashboardsDir, "example", "example.json"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dashboardsDir, "example", "other.json"))
+	assert.NoError(t, err)
+
+	// Mixins removed from the configuration are removed.
+	writeFile(t, dir, "mixins.yaml", "mixins: []\n")
+	assert.Empty(t, s.sync(context.Background()))
+	assert.Equal(t, 3, *reloads)
+	_, err = os.Stat(h.ruleProvisioner.ruleFile("example"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dashboardsDir, "example"))
+	assert.True(t, os.IsNotExist(err))
+	// The rules of other mixins are left alone.
+	_, err = os.Stat(h.ruleProvisioner.ruleFile("existing"))
+	assert.NoError(t, err)
+}
+
+func TestMixinSyncerOptions(t *testing.T) {
+	h, _, _ := newTestRuleProvisioningHandler(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "mixin.libsonnet", `{
+  _config+:: { selector: 'job="default"' },
+  prometheusRules+:: {
+    groups+: [{
+      name: 'example',
+      rules: [{ record: 'job:up:sum', expr: 'sum by (job) (up{%s, cluster="%s"})' % [$._config.selector, std.extVar('cluster')] }],
+    }],
+  },
+}
+`)
+	// The options of a mixin installed into a workspace.
+	writeFile(t, dir, "mixins.yaml", `mixins:
+- name: example
+  path: mixin.libsonnet
+  options:
+    yaml: true
+    ext_str: {cluster: eu-1}
+    config: '{ selector: ''job="node"'' }'
+`)
+
+	s := &mixinSyncer{
+		configFile: filepath.Join(dir, "mixins.yaml"),
+		handlers:   map[string]*ruleProvisioningHandler{"prometheus": h},
+	}
+	assert.Empty(t, s.sync(context.Background()))
+	rules, err := ioutil.ReadFile(h.ruleProvisioner.ruleFile("example"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(rules), `up{job="node", cluster="eu-1"}`)
+}
+
+func TestMixinSyncerWebhook(t *testing.T) {
+	h, _, reloads := newTestRuleProvisioningHandler(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "mixin.libsonnet", strings.Replace(testPullMixin, "sum by (job) (up)", "sum by (job) (up", 1))
+	writeFile(t, dir, "mixins.yaml", "mixins:\n- name: example\n  path: mixin.libsonnet\n")
+
+	s := &mixinSyncer{
+		configFile: filepath.Join(dir, "mixins.yaml"),
+		handlers:   map[string]*ruleProvisioningHandler{"prometheus": h},
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/sync", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "mixin example: ")
+	assert.Equal(t, 0, *reloads)
+
+	writeFile(t, dir, "mixin.libsonnet", testPullMixin)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/sync", nil))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 1, *reloads)
+}
@@ -0,0 +1,413 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// registryFlags are the flags of commands querying the registries, shared by
+// list and install.
+func registryFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "registries",
+			Usage: "File configuring the registries to look up mixins in. Defaults to mixtool/registries.yaml in the user config directory, if it exists, or monitoring.mixins.dev",
+		},
+		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "Use only the cached registries, without querying them",
+		},
+		cli.DurationFlag{
+			Name:  "registry-cache-ttl",
+			Usage: "How long a cached registry is used before revalidating it",
+			Value: time.Hour,
+		},
+	}
+}
+
+// registryCache fetches registries, caching them under the user cache
+// directory. Cached registries are used as they are until their TTL expires,
+// and are revalidated with ETag and If-Modified-Since after.
+type registryCache struct {
+	// dir is the directory of the cache. If it is empty, nothing is cached.
+	dir     string
+	ttl     time.Duration
+	offline bool
+	client  *http.Client
+}
+
+// registryCacheEntry is what is known about a cached registry, stored next
+// to it.
+type registryCacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+func newRegistryCache(c *cli.Context) (*registryCache, error) {
+	cache := &registryCache{
+		ttl:     c.Duration("registry-cache-ttl"),
+		offline: c.Bool("offline"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		if cache.offline {
+			return nil, fmt.Errorf("no cache directory to use offline: %w", err)
+		}
+		return cache, nil
+	}
+	cache.dir = filepath.Join(dir, "mixtool", "registry")
+	return cache, nil
+}
+
+// get returns the registry at url, queried with the given headers. If the
+// registry can't be queried, a cached version is used regardless of its age.
+func (c *registryCache) get(url string, headers map[string]string) ([]byte, error) {
+	body, entry, err := c.load(url)
+	cached := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if cached && (c.offline || time.Since(entry.Fetched) < c.ttl) {
+		return body, nil
+	}
+	if c.offline {
+		return nil, fmt.Errorf("registry %s isn't cached, it needs to be queried without --offline once", url)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "mixtool-list")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if cached {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		if cached {
+			fmt.Fprintf(os.Stderr, "using the registry cached %s ago: %v\n", time.Since(entry.Fetched).Round(time.Second), err)
+			return body, nil
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		if !cached {
+			return nil, fmt.Errorf("registry %s not modified, but it isn't cached", url)
+		}
+		entry.Fetched = time.Now()
+	case http.StatusOK:
+		body, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		entry = &registryCacheEntry{
+			URL:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			Fetched:      time.Now(),
+		}
+	default:
+		return nil, fmt.Errorf("querying registry %s: unexpected status %s", url, res.Status)
+	}
+
+	if err := c.store(url, body, entry); err != nil {
+		return nil, fmt.Errorf("caching registry %s: %w", url, err)
+	}
+	return body, nil
+}
+
+// files returns the files of the cached registry at url and of what is known
+// about it.
+func (c *registryCache) files(url string) (string, string) {
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(url)))
+	return filepath.Join(c.dir, key+".json"), filepath.Join(c.dir, key+".meta.json")
+}
+
+func (c *registryCache) load(url string) ([]byte, *registryCacheEntry, error) {
+	if c.dir == "" {
+		return nil, nil, os.ErrNotExist
+	}
+	bodyFile, entryFile := c.files(url)
+
+	content, err := ioutil.ReadFile(entryFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry registryCacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, nil, fmt.Errorf("reading cached registry %s: %w", url, err)
+	}
+
+	body, err := ioutil.ReadFile(bodyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, &entry, nil
+}
+
+func (c *registryCache) store(url string, body []byte, entry *registryCacheEntry) error {
+	if c.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	bodyFile, entryFile := c.files(url)
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// the entry is written last, so that a registry is only cached once both
+	// files are complete
+	if err := writeFileAtomic(bodyFile, body); err != nil {
+		return err
+	}
+	return writeFileAtomic(entryFile, content)
+}
+
+// writeFileAtomic writes a file by renaming a temporary file, so that readers
+// never see a partial file.
+func writeFileAtomic(filename string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// defaultRegistry is the name of monitoring.mixins.dev, if no registries are
+// configured.
+const defaultRegistry = "default"
+
+// registriesConfig configures the registries to look up mixins in.
+type registriesConfig struct {
+	Registries []registryConfig `yaml:"registries"`
+}
+
+type registryConfig struct {
+	// Name is the namespace of the mixins of the registry, like internal
+	// for internal/kafka.
+	Name string `yaml:"name"`
+	// URL is the URL of the registry, or the path of a local file.
+	URL string `yaml:"url"`
+	// Priority orders the registries names without a namespace are looked
+	// up in, the highest first.
+	Priority int `yaml:"priority,omitempty"`
+	// Headers are sent to the registry, like Authorization. Environment
+	// variables in their values are expanded.
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// loadRegistriesConfig reads and validates a registries configuration,
+// resolving the paths of local registries and sorting the registries by
+// priority. Without a filename, the configuration in the user config
+// directory is read if it exists, and monitoring.mixins.dev is used if not.
+func loadRegistriesConfig(filename string) (*registriesConfig, error) {
+	explicit := filename != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return defaultRegistriesConfig(defaultWebsite), nil
+		}
+		filename = filepath.Join(dir, "mixtool", "registries.yaml")
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return defaultRegistriesConfig(defaultWebsite), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c registriesConfig
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing registries config %s: %w", filename, err)
+	}
+
+	names := map[string]bool{}
+	for i := range c.Registries {
+		r := &c.Registries[i]
+		if !validMixinName.MatchString(r.Name) {
+			return nil, fmt.Errorf("registry %d: invalid name %q", i, r.Name)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("registry %s: duplicate name", r.Name)
+		}
+		names[r.Name] = true
+		if r.URL == "" {
+			return nil, fmt.Errorf("registry %s: no url given", r.Name)
+		}
+
+		if !isRemoteRegistry(r.URL) && !filepath.IsAbs(r.URL) {
+			r.URL = filepath.Join(filepath.Dir(filename), r.URL)
+		}
+		for k, v := range r.Headers {
+			r.Headers[k] = os.ExpandEnv(v)
+		}
+	}
+	if len(c.Registries) == 0 {
+		return nil, fmt.Errorf("no registries configured in %s", filename)
+	}
+
+	sort.SliceStable(c.Registries, func(i, j int) bool {
+		return c.Registries[i].Priority > c.Registries[j].Priority
+	})
+	return &c, nil
+}
+
+// defaultRegistriesConfig configures a single registry at url.
+func defaultRegistriesConfig(url string) *registriesConfig {
+	return &registriesConfig{Registries: []registryConfig{{Name: defaultRegistry, URL: url}}}
+}
+
+func isRemoteRegistry(u string) bool {
+	parsed, err := url.ParseRequestURI(u)
+	return err == nil && parsed.Scheme != "" && parsed.Scheme != "file"
+}
+
+// registries looks up mixins in the configured registries.
+type registries struct {
+	config *registriesConfig
+	cache  *registryCache
+}
+
+func newRegistries(c *cli.Context) (*registries, error) {
+	config, err := loadRegistriesConfig(c.String("registries"))
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newRegistryCache(c)
+	if err != nil {
+		return nil, err
+	}
+	return &registries{config: config, cache: cache}, nil
+}
+
+// mixins returns the mixins of a registry.
+func (r *registries) mixins(registry registryConfig) ([]mixin, error) {
+	var body []byte
+	var err error
+	if isRemoteRegistry(registry.URL) {
+		body, err = r.cache.get(registry.URL, registry.Headers)
+	} else {
+		body, err = ioutil.ReadFile(strings.TrimPrefix(registry.URL, "file://"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: %w", registry.Name, err)
+	}
+
+	mixins, err := parseMixinJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: %w", registry.Name, err)
+	}
+	for i := range mixins {
+		mixins[i].Registry = registry.Name
+	}
+	return mixins, nil
+}
+
+// all returns the mixins of all registries, by priority of the registries.
+func (r *registries) all() ([]mixin, error) {
+	var all []mixin
+	for _, registry := range r.config.Registries {
+		mixins, err := r.mixins(registry)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, mixins...)
+	}
+	return all, nil
+}
+
+// lookup returns the mixin of a name, which is namespaced by the name of a
+// registry like internal/kafka, or looked up in the registries by priority.
+// A registry that can't be queried fails the lookup rather than being
+// skipped, so that a name never resolves to a mixin of another registry by
+// accident.
+func (r *registries) lookup(name string) (*mixin, error) {
+	namespace := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+
+	found := false
+	for _, registry := range r.config.Registries {
+		if namespace != "" && registry.Name != namespace {
+			continue
+		}
+		found = true
+
+		mixins, err := r.mixins(registry)
+		if err != nil {
+			return nil, err
+		}
+		for i := range mixins {
+			if mixins[i].Name == name {
+				return &mixins[i], nil
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no registry %s configured", namespace)
+	}
+	return nil, fmt.Errorf("Could not find mixin with name %s", name)
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cacheMixins(cache *registryCache, url string) ([]mixin, error) {
+	body, err := cache.get(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseMixinJSON(body)
+}
+
+func TestRegistryCache(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(exampleMixins))
+	}))
+	defer srv.Close()
+
+	cache := &registryCache{dir: t.TempDir(), ttl: time.Hour, client: srv.Client()}
+	mixins, err := cacheMixins(cache, srv.URL)
+	assert.NoError(t, err)
+	assert.Len(t, mixins, 3)
+
+	// Within the TTL, the cache is used as is.
+	_, err = cacheMixins(cache, srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, requests)
+
+	// After, it is revalidated.
+	cache.ttl = 0
+	mixins, err = cacheMixins(cache, srv.URL)
+	assert.NoError(t, err)
+	assert.Len(t, mixins, 3)
+	assert.Equal(t, []string{"", `"v1"`}, requests)
+
+	// Offline, the cache is used regardless of its age, and unknown
+	// registries fail.
+	cache.offline = true
+	_, err = cacheMixins(cache, srv.URL)
+	assert.NoError(t, err)
+	_, err = cache.get(srv.URL+"/other.json", nil)
+	assert.Error(t, err)
+	assert.Len(t, requests, 2)
+
+	// The cache is used if the registry can't be queried.
+	cache.offline = false
+	srv.Close()
+	mixins, err = cacheMixins(cache, srv.URL)
+	assert.NoError(t, err)
+	assert.Len(t, mixins, 3)
+}
+
+func TestRegistryCacheLastModified(t *testing.T) {
+	lastModified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	var notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == lastModified {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(exampleMixins))
+	}))
+	defer srv.Close()
+
+	cache := &registryCache{dir: t.TempDir(), client: srv.Client()}
+	for i := 0; i < 2; i++ {
+		mixins, err := cacheMixins(cache, srv.URL)
+		assert.NoError(t, err)
+		assert.Len(t, mixins, 3)
+	}
+	assert.Equal(t, 1, notModified)
+}
+
+func TestLoadRegistriesConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TEST_REGISTRY_TOKEN", "secret")
+
+	c, err := loadRegistriesConfig(writeFile(t, dir, "registries.yaml", `registries:
+- name: default
+  url: https://monitoring.mixins.dev/mixins.json
+- name: internal
+  url: https://mixins.example.com/mixins.json
+  priority: 10
+  headers:
+    Authorization: Bearer ${TEST_REGISTRY_TOKEN}
+- name: team
+  url: team.json
+  priority: 10
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []registryConfig{
+		{Name: "internal", URL: "https://mixins.example.com/mixins.json", Priority: 10, Headers: map[string]string{"Authorization": "Bearer secret"}},
+		{Name: "team", URL: filepath.Join(dir, "team.json"), Priority: 10},
+		{Name: "default", URL: "https://monitoring.mixins.dev/mixins.json"},
+	}, c.Registries)
+
+	for _, invalid := range []string{
+		"registries: []",
+		"registries: [{name: a/b, url: a.json}]",
+		"registries: [{name: a, url: a.json}, {name: a, url: b.json}]",
+		"registries: [{name: a}]",
+		"registries: [{name: a, url: a.json, token: x}]",
+	} {
+		_, err := loadRegistriesConfig(writeFile(t, dir, "invalid.yaml", invalid))
+		assert.Error(t, err, invalid)
+	}
+
+	// Only a given file must exist.
+	_, err = loadRegistriesConfig(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	c, err = loadRegistriesConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRegistriesConfig(defaultWebsite), c)
+}
+
+func TestRegistriesLookup(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if authorization != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"mixins": [
+			{"name": "kafka", "source": "https://git.example.com/kafka-mixin"},
+			{"name": "ceph", "source": "https://git.example.com/ceph-mixin"}
+		]}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	r := &registries{
+		config: &registriesConfig{Registries: []registryConfig{
+			{Name: "internal", URL: srv.URL, Priority: 10, Headers: map[string]string{"Authorization": "Bearer secret"}},
+			{Name: defaultRegistry, URL: writeFile(t, dir, "mixins.json", exampleMixins)},
+		}},
+		cache: &registryCache{dir: t.TempDir(), client: srv.Client()},
+	}
+
+	for name, source := range map[string]string{
+		"ceph":           "https://git.example.com/ceph-mixin",
+		"default/ceph":   "https://github.com/ceph/ceph-mixins",
+		"cortex":         "https://github.com/grafana/cortex-jsonnet",
+		"internal/kafka": "https://git.example.com/kafka-mixin",
+	} {
+		m, err := r.lookup(name)
+		assert.NoError(t, err, name)
+		if assert.NotNil(t, m, name) {
+			assert.Equal(t, source, m.URL, name)
+		}
+	}
+	assert.Equal(t, "Bearer secret", authorization)
+
+	for _, name := range []string{"internal/cortex", "unknown", "other/ceph"} {
+		_, err := r.lookup(name)
+		assert.Error(t, err, name)
+	}
+
+	all, err := r.all()
+	assert.NoError(t, err)
+	assert.Len(t, all, 5)
+	assert.Equal(t, "internal", all[0].Registry)
+	assert.Equal(t, defaultRegistry, all[4].Registry)
+
+	// A registry that can't be queried fails the lookup, rather than names
+	// being looked up in the next registry.
+	r.config.Registries[0].Headers = nil
+	r.cache.dir = t.TempDir()
+	_, err = r.lookup("cortex")
+	assert.Error(t, err)
+}
@@ -0,0 +1,333 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// rulerAPIPaths are the default paths of the ruler config APIs of Mimir and
+// Cortex for Prometheus rules, and of Loki for Loki rules.
+var rulerAPIPaths = map[mixer.DataSource]string{
+	mixer.Prometheus: "/prometheus/config/v1/rules",
+	mixer.Loki:       "/loki/api/v1/rules",
+}
+
+func rulesCommand() cli.Command {
+	return cli.Command{
+		Name:        "rules",
+		Usage:       "Manage the rules of a mixin in a ruler",
+		Description: "Manage the rules and alerts of a mixin in a Mimir, Cortex or Loki ruler",
+		Subcommands: cli.Commands{
+			rulesSyncCommand(),
+		},
+	}
+}
+
+func rulesSyncCommand() cli.Command {
+	return cli.Command{
+		Name:        "sync",
+		Usage:       "Sync the rules of a mixin to a ruler",
+		Description: "Create, update and delete the rule groups of a ruler namespace through the ruler config API, so that they match the rules and alerts of the mixin",
+		ArgsUsage:   "<mixin.libsonnet>",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "address",
+				Usage: "Address of the ruler, like http://mimir:8080",
+			},
+			cli.StringFlag{
+				Name:  "namespace",
+				Usage: "Ruler namespace to sync the rule groups of the mixin into",
+			},
+			cli.StringFlag{
+				Name:  "tenant-id",
+				Usage: "Tenant to sync the rules of, sent as X-Scope-OrgID header",
+			},
+			cli.StringFlag{
+				Name:  "api-path",
+				Usage: "Path of the ruler config API. Defaults to /prometheus/config/v1/rules for Prometheus and /loki/api/v1/rules for Loki rules",
+			},
+			cli.StringFlag{
+				Name:  "data-source, s",
+				Usage: "The source the rules and alerts are written for (loki,prometheus)",
+				Value: "prometheus",
+			},
+			cli.StringSliceFlag{
+				Name:  "jpath, J",
+				Usage: "Add folders to be used as vendor folders",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only print the changes that would be made",
+			},
+		}, httpClientFlags("the ruler")...),
+		Action: rulesSyncAction,
+	}
+}
+
+func rulesSyncAction(c *cli.Context) error {
+	filename := c.Args().First()
+	if filename == "" {
+		return fmt.Errorf("no jsonnet file given")
+	}
+
+	address, namespace := c.String("address"), c.String("namespace")
+	if address == "" || namespace == "" {
+		return fmt.Errorf("both an address and a namespace are required")
+	}
+
+	dataSource := mixer.DataSource(c.String("data-source"))
+	apiPath := c.String("api-path")
+	if apiPath == "" {
+		var ok bool
+		if apiPath, ok = rulerAPIPaths[dataSource]; !ok {
+			return fmt.Errorf("unsupported data source %q", dataSource)
+		}
+	}
+
+	jPath, err := availableVendor(filename, c.StringSlice("jpath"))
+	if err != nil {
+		return err
+	}
+
+	groups, err := mixinRuleGroups(mixer.NewEvaluator(jPath), &mixer.RulesAlertsOptions{
+		DataSource: dataSource,
+		ImportPath: filename,
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return err
+	}
+
+	ruler := &rulerClient{
+		client:   client,
+		address:  address,
+		apiPath:  apiPath,
+		tenantID: c.String("tenant-id"),
+	}
+	return syncRuleGroups(os.Stdout, ruler, namespace, groups, c.Bool("dry-run"))
+}
+
+// ruleGroup is a rule group as generated and as returned by the ruler API,
+// kept generic so that groups can be compared and sent back unchanged.
+type ruleGroup map[string]interface{}
+
+func (g ruleGroup) name() string {
+	name, _ := g["name"].(string)
+	return name
+}
+
+type ruleGroups struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+// mixinRuleGroups evaluates and validates the rules and alerts of a mixin.
+func mixinRuleGroups(e mixer.Evaluator, opts *mixer.RulesAlertsOptions) ([]ruleGroup, error) {
+	out, err := e.Exec(mixer.NewRulesAlertsMixin(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := mixer.JSONtoYaml(out)
+	if err != nil {
+		return nil, err
+	}
+
+	linter := mixer.NewPrometheusLinter()
+	if opts.DataSource == mixer.Loki {
+		linter = mixer.NewLokiLinter()
+	}
+	if errs := linter(content); len(errs) > 0 {
+		return nil, newValidationError(errs)
+	}
+
+	var groups ruleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, err
+	}
+	return groups.Groups, nil
+}
+
+// rulerClient talks to the ruler config API of Mimir, Cortex or Loki.
+type rulerClient struct {
+	client   *http.Client
+	address  string
+	apiPath  string
+	tenantID string
+}
+
+func (c *rulerClient) do(method string, body io.Reader, elem ...string) ([]byte, int, error) {
+	u, err := url.Parse(c.address)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range elem {
+		elem[i] = url.PathEscape(elem[i])
+	}
+	u.RawPath = path.Join(append([]string{u.EscapedPath(), c.apiPath}, elem...)...)
+	u.Path, err = url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+	if c.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", c.tenantID)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return nil, resp.StatusCode, fmt.Errorf("%s %s: received %s: %s", method, u.Path, resp.Status, bytes.TrimSpace(content))
+	}
+	return content, resp.StatusCode, nil
+}
+
+// groups returns the rule groups of a namespace.
+func (c *rulerClient) groups(namespace string) ([]ruleGroup, error) {
+	content, status, err := c.do("GET", nil, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var namespaces map[string][]ruleGroup
+	if err := yaml.Unmarshal(content, &namespaces); err != nil {
+		return nil, fmt.Errorf("parsing rule groups of namespace %s: %w", namespace, err)
+	}
+	return namespaces[namespace], nil
+}
+
+// setGroup creates or updates a rule group in a namespace.
+func (c *rulerClient) setGroup(namespace string, group ruleGroup) error {
+	content, err := yaml.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, status, err := c.do("POST", bytes.NewReader(content), namespace)
+	if err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("ruler config API not found at %s", c.apiPath)
+	}
+	return err
+}
+
+// deleteGroup deletes a rule group from a namespace.
+func (c *rulerClient) deleteGroup(namespace, name string) error {
+	_, status, err := c.do("DELETE", nil, namespace, name)
+	if err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("rule group %s not found in namespace %s", name, namespace)
+	}
+	return err
+}
+
+// syncRuleGroups creates, updates and deletes the rule groups of a namespace
+// to match groups, printing each change to w.
+func syncRuleGroups(w io.Writer, ruler *rulerClient, namespace string, groups []ruleGroup, dryRun bool) error {
+	existing, err := ruler.groups(namespace)
+	if err != nil {
+		return err
+	}
+
+	remote := make(map[string]ruleGroup, len(existing))
+	for _, g := range existing {
+		remote[g.name()] = g
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "would "
+	}
+
+	changes := 0
+	local := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		name := g.name()
+		local[name] = true
+
+		r, ok := remote[name]
+		if ok && reflect.DeepEqual(r, g) {
+			continue
+		}
+
+		action := "create"
+		if ok {
+			action = "update"
+		}
+		fmt.Fprintf(w, "%s%s rule group %s/%s\n", prefix, action, namespace, name)
+		changes++
+		if dryRun {
+			continue
+		}
+		if err := ruler.setGroup(namespace, g); err != nil {
+			return fmt.Errorf("failed to %s rule group %s: %w", action, name, err)
+		}
+	}
+
+	var deleted []string
+	for name := range remote {
+		if !local[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+	for _, name := range deleted {
+		fmt.Fprintf(w, "%sdelete rule group %s/%s\n", prefix, namespace, name)
+		changes++
+		if dryRun {
+			continue
+		}
+		if err := ruler.deleteGroup(namespace, name); err != nil {
+			return fmt.Errorf("failed to delete rule group %s: %w", name, err)
+		}
+	}
+
+	if changes == 0 {
+		fmt.Fprintf(w, "rule groups of namespace %s are up to date\n", namespace)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeRuler is an in-memory stand-in for the ruler config API of a tenant.
+type fakeRuler struct {
+	mtx      sync.Mutex
+	tenant   string
+	prefix   string
+	groups   map[string]map[string]ruleGroup
+	requests []string
+}
+
+func (f *fakeRuler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.Header.Get("X-Scope-OrgID") != f.tenant {
+		http.Error(w, "no org id", http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, f.prefix+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	elems := strings.SplitN(strings.TrimPrefix(r.URL.Path, f.prefix+"/"), "/", 2)
+	namespace := elems[0]
+
+	switch {
+	case r.Method == "GET" && len(elems) == 1:
+		groups, ok := f.groups[namespace]
+		if !ok {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+			return
+		}
+		var list []ruleGroup
+		for _, g := range groups {
+			list = append(list, g)
+		}
+		out, _ := yaml.Marshal(map[string][]ruleGroup{namespace: list})
+		w.Write(out)
+	case r.Method == "POST" && len(elems) == 1:
+		body, _ := ioutil.ReadAll(r.Body)
+		var g ruleGroup
+		if err := yaml.Unmarshal(body, &g); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.groups[namespace] == nil {
+			f.groups[namespace] = map[string]ruleGroup{}
+		}
+		f.groups[namespace][g.name()] = g
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "DELETE" && len(elems) == 2:
+		if _, ok := f.groups[namespace][elems[1]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.groups[namespace], elems[1])
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func parseRuleGroups(t *testing.T, content string) []ruleGroup {
+	var groups ruleGroups
+	if err := yaml.Unmarshal([]byte(content), &groups); err != nil {
+		t.Fatal(err)
+	}
+	return groups.Groups
+}
+
+func TestSyncRuleGroups(t *testing.T) {
+	remote := parseRuleGroups(t, `
+groups:
+- name: unchanged
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+- name: changed
+  rules:
+  - alert: InstanceDown
+    expr: up == 0
+    for: 5m
+- name: removed
+  rules:
+  - record: job:down:sum
+    expr: sum by (job) (1 - up)
+`)
+	local := parseRuleGroups(t, `
+groups:
+- name: unchanged
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+- name: changed
+  rules:
+  - alert: InstanceDown
+    expr: up == 0
+    for: 10m
+- name: added
+  rules:
+  - record: instance:up:max
+    expr: max by (instance) (up)
+`)
+
+	fake := &fakeRuler{
+		tenant: "team-a",
+		prefix: rulerAPIPaths["prometheus"],
+		groups: map[string]map[string]ruleGroup{"mixin": {}},
+	}
+	for _, g := range remote {
+		fake.groups["mixin"][g.name()] = g
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ruler := &rulerClient{
+		client:   http.DefaultClient,
+		address:  srv.URL,
+		apiPath:  rulerAPIPaths["prometheus"],
+		tenantID: "team-a",
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, syncRuleGroups(&out, ruler, "mixin", local, true))
+	assert.Equal(t, "would update rule group mixin/changed\nwould create rule group mixin/added\nwould delete rule group mixin/removed\n", out.String())
+	assert.Equal(t, []string{"GET /prometheus/config/v1/rules/mixin"}, fake.requests)
+
+	out.Reset()
+	assert.NoError(t, syncRuleGroups(&out, ruler, "mixin", local, false))
+	assert.Equal(t, "update rule group mixin/changed\ncreate rule group mixin/added\ndelete rule group mixin/removed\n", out.String())
+
+	synced := map[string]ruleGroup{}
+	for _, g := range local {
+		synced[g.name()] = g
+	}
+	assert.Equal(t, synced, fake.groups["mixin"])
+
+	out.Reset()
+	assert.NoError(t, syncRuleGroups(&out, ruler, "mixin", local, false))
+	assert.Equal(t, "rule groups of namespace mixin are up to date\n", out.String())
+}
+
+func TestSyncRuleGroupsNewNamespace(t *testing.T) {
+	fake := &fakeRuler{
+		prefix: rulerAPIPaths["loki"],
+		groups: map[string]map[string]ruleGroup{},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ruler := &rulerClient{client: http.DefaultClient, address: srv.URL, apiPath: rulerAPIPaths["loki"]}
+	local := parseRuleGroups(t, `
+groups:
+- name: logs
+  rules:
+  - alert: ManyErrors
+    expr: sum(count_over_time({job="app"} |= "error" [5m])) > 3
+`)
+
+	var out bytes.Buffer
+	assert.NoError(t, syncRuleGroups(&out, ruler, "app", local, false))
+	assert.Equal(t, "create rule group app/logs\n", out.String())
+	assert.Len(t, fake.groups["app"], 1)
+
+	ruler.tenantID = "other"
+	assert.Error(t, syncRuleGroups(&out, ruler, "app", local, false))
+}
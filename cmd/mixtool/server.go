@@ -16,15 +16,26 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
 	"github.com/urfave/cli"
 )
 
@@ -32,7 +43,7 @@ func serverCommand() cli.Command {
 	return cli.Command{
 		Name:        "server",
 		Usage:       "Start a server to provision Prometheus rule file(s) with.",
-		Description: "Start a server to provision Prometheus rule file(s) with.",
+		Description: "Start a server to provision Prometheus rule file(s) with, one file per mixin in the rules directory. The server either receives the rules of mixins pushed by `mixtool install`, or renders the mixins configured with --mixins itself.",
 		Flags: []cli.Flag{
 			cli.StringFlag{
 				Name:  "bind-address",
@@ -44,70 +55,724 @@ func serverCommand() cli.Command {
 				Usage: "Prometheus address to reload after provisioning the rule file(s).",
 			},
 			cli.StringFlag{
-				Name:  "rule-file",
-				Usage: "File to provision rules into.",
+				Name:  "rules-dir",
+				Usage: "Directory to provision rule files into, one per mixin.",
+			},
+			cli.StringFlag{
+				Name:   "rule-file",
+				Usage:  "Removed, use --rules-dir.",
+				Hidden: true,
+			},
+			cli.StringFlag{
+				Name:  "loki-rules-dir",
+				Usage: "Directory of the Loki ruler to provision Loki rule files into, one per mixin. It must be the directory of a tenant in the ruler's local storage, like /loki/rules/fake. Loki rules are only provisioned if set.",
+			},
+			cli.StringFlag{
+				Name:  "alertmanager-config-dir",
+				Usage: "Directory to provision Alertmanager configuration files into. Alertmanager configurations are only provisioned if set.",
+			},
+			cli.StringFlag{
+				Name:  "alertmanager-reload-url",
+				Value: "http://127.0.0.1:9093/-/reload",
+				Usage: "Alertmanager address to reload after provisioning configuration file(s).",
+			},
+			cli.StringSliceFlag{
+				Name:  "reload-target",
+				Usage: "Additional target to request after provisioning, as kind=KIND,url=URL[,method=METHOD][,status=STATUS]. KIND is one of prometheus, loki or alertmanager; METHOD defaults to POST and STATUS to 200.",
+			},
+			cli.StringFlag{
+				Name:  "web-config-file",
+				Usage: "Path to a web configuration file enabling TLS and authentication, in the format of the Prometheus exporter-toolkit.",
+			},
+			cli.StringFlag{
+				Name:  "tls-cert-file",
+				Usage: "TLS certificate to serve with. Overrides the web configuration file.",
+			},
+			cli.StringFlag{
+				Name:  "tls-key-file",
+				Usage: "TLS key to serve with. Overrides the web configuration file.",
+			},
+			cli.StringFlag{
+				Name:  "tls-client-ca-file",
+				Usage: "CA to verify client certificates with, requiring them. Overrides the web configuration file.",
+			},
+			cli.StringFlag{
+				Name:  "bearer-token-file",
+				Usage: "File with a bearer token clients must present. Overrides the web configuration file.",
+			},
+			cli.DurationFlag{
+				Name:  "read-timeout",
+				Value: time.Minute,
+				Usage: "Maximum duration for reading an entire request, including the body.",
+			},
+			cli.DurationFlag{
+				Name:  "write-timeout",
+				Value: time.Minute,
+				Usage: "Maximum duration before timing out writes of a response, including provisioning and reloading.",
+			},
+			cli.DurationFlag{
+				Name:  "idle-timeout",
+				Value: 5 * time.Minute,
+				Usage: "Maximum duration to wait for the next request on keep-alive connections.",
+			},
+			cli.DurationFlag{
+				Name:  "shutdown-timeout",
+				Value: 30 * time.Second,
+				Usage: "Maximum duration to wait for in-flight requests when shutting down.",
+			},
+			cli.IntFlag{
+				Name:  "history-size",
+				Value: 5,
+				Usage: "Number of previous versions to keep of each provisioned file, to roll back to. 0 disables rolling back; the last version is always kept to restore if a reload fails.",
+			},
+			cli.Int64Flag{
+				Name:  "max-body-bytes",
+				Value: 10 << 20,
+				Usage: "Maximum size of a provisioned file in bytes.",
+			},
+			cli.StringFlag{
+				Name:  "mixins",
+				Usage: "Configuration file of mixins to render and provision periodically and on POST /api/v1/sync, instead of waiting for them to be pushed.",
+			},
+			cli.DurationFlag{
+				Name:  "sync-interval",
+				Value: 5 * time.Minute,
+				Usage: "Interval to render and provision the configured mixins at.",
+			},
+			cli.StringFlag{
+				Name:  "dashboards-dir",
+				Usage: "Directory to write the dashboards of the configured mixins into, one subdirectory per mixin, for Grafana to provision them from.",
 			},
 		},
 		Action: serverAction,
 	}
 }
 
+// artifactKind is a kind of artifact provisioned by the server, like
+// Prometheus rules, with the targets to reload after provisioning it.
+type artifactKind struct {
+	name          string
+	path          string
+	dir           string
+	linter        mixer.Linter
+	reloadTargets []reloadTarget
+}
+
+// serverArtifactKinds returns the artifact kinds enabled by flags.
+func serverArtifactKinds(c *cli.Context) ([]*artifactKind, error) {
+	if c.String("rule-file") != "" {
+		return nil, fmt.Errorf("--rule-file has been removed, the rules of each mixin are provisioned into a directory given with --rules-dir")
+	}
+	rulesDir := c.String("rules-dir")
+	if rulesDir == "" {
+		return nil, fmt.Errorf("no rules directory given")
+	}
+
+	kinds := []*artifactKind{{
+		name:   "prometheus",
+		path:   "/api/v1/rules",
+		dir:    rulesDir,
+		linter: mixer.NewPrometheusLinter(),
+	}}
+	if u := c.String("prometheus-reload-url"); u != "" {
+		kinds[0].reloadTargets = append(kinds[0].reloadTargets, reloadTarget{URL: u, Method: "POST", Status: http.StatusOK})
+	}
+
+	if dir := c.String("loki-rules-dir"); dir != "" {
+		// The Loki ruler polls its rules directory, so there is nothing to
+		// reload by default.
+		kinds = append(kinds, &artifactKind{
+			name:   "loki",
+			path:   "/api/v1/loki/rules",
+			dir:    dir,
+			linter: mixer.NewLokiLinter(),
+		})
+	}
+
+	if dir := c.String("alertmanager-config-dir"); dir != "" {
+		k := &artifactKind{
+			name:   "alertmanager",
+			path:   "/api/v1/alertmanager/configs",
+			dir:    dir,
+			linter: mixer.NewAlertmanagerLinter(),
+		}
+		if u := c.String("alertmanager-reload-url"); u != "" {
+			k.reloadTargets = append(k.reloadTargets, reloadTarget{URL: u, Method: "POST", Status: http.StatusOK})
+		}
+		kinds = append(kinds, k)
+	}
+
+	for _, flag := range c.StringSlice("reload-target") {
+		name, t, err := parseReloadTarget(flag)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, k := range kinds {
+			if k.name == name {
+				k.reloadTargets = append(k.reloadTargets, t)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("reload target %q: %s artifacts are not provisioned", flag, name)
+		}
+	}
+
+	return kinds, nil
+}
+
 func serverAction(c *cli.Context) error {
 	bindAddress := c.String("bind-address")
-	http.Handle("/api/v1/rules", &ruleProvisioningHandler{
-		ruleProvisioner: &ruleProvisioner{
-			ruleFile: c.String("rule-file"),
-		},
-		prometheusReloader: &prometheusReloader{
-			prometheusReloadURL: c.String("prometheus-reload-url"),
-		},
+	kinds, err := serverArtifactKinds(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	status := &provisioningStatus{}
+	metrics := newServerMetrics()
+	mux := http.NewServeMux()
+	handlers := map[string]*ruleProvisioningHandler{}
+	for _, k := range kinds {
+		if err := os.MkdirAll(k.dir, 0755); err != nil {
+			return fmt.Errorf("unable to create %s directory: %w", k.name, err)
+		}
+		h := &ruleProvisioningHandler{
+			kind:         k.name,
+			path:         k.path,
+			maxBodyBytes: c.Int64("max-body-bytes"),
+			ruleProvisioner: &ruleProvisioner{
+				rulesDir:    k.dir,
+				linter:      k.linter,
+				historySize: c.Int("history-size"),
+			},
+			reloader: &reloader{targets: k.reloadTargets},
+			status:   status,
+			metrics:  metrics,
+		}
+		if err := metrics.init(k.name, h.ruleProvisioner); err != nil {
+			return err
+		}
+		mux.Handle(k.path, h)
+		mux.Handle(k.path+"/", h)
+		handlers[k.name] = h
+	}
+	mux.Handle("/api/v1/status", status)
+	mux.Handle("/metrics", metrics.handler())
+
+	if configFile := c.String("mixins"); configFile != "" {
+		// Fail early on an invalid configuration, later ones are only logged.
+		if _, err := loadMixinsConfig(configFile); err != nil {
+			return err
+		}
+		syncer := &mixinSyncer{
+			configFile:    configFile,
+			handlers:      handlers,
+			dashboardsDir: c.String("dashboards-dir"),
+		}
+		go syncer.run(ctx, c.Duration("sync-interval"))
+		mux.Handle("/api/v1/sync", syncer)
+	}
+
+	web, err := serverWebConfig(c)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := web.tls()
+	if err != nil {
+		return err
+	}
+
+	// Health endpoints don't require authentication, so that they can be
+	// used as probes.
+	root := http.NewServeMux()
+	root.HandleFunc("/-/healthy", healthyHandler)
+	root.Handle("/-/ready", readyHandler(kinds))
+	root.Handle("/", web.authenticate(mux))
+
+	srv := &http.Server{
+		Addr:         bindAddress,
+		Handler:      root,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  c.Duration("read-timeout"),
+		WriteTimeout: c.Duration("write-timeout"),
+		IdleTimeout:  c.Duration("idle-timeout"),
+	}
+
+	return serve(ctx, srv, c.Duration("shutdown-timeout"), func() error {
+		if tlsConfig != nil {
+			return srv.ListenAndServeTLS(web.TLSConfig.CertFile, web.TLSConfig.KeyFile)
+		}
+		return srv.ListenAndServe()
 	})
-	return http.ListenAndServe(bindAddress, nil)
 }
 
+// serve runs listenAndServe until ctx is done, then shuts srv down gracefully,
+// waiting up to timeout for in-flight requests to finish.
+func serve(ctx context.Context, srv *http.Server, timeout time.Duration, listenAndServe func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- listenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down server: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serverWebConfig returns the web configuration of the server, read from the
+// web configuration file and overridden by flags.
+func serverWebConfig(c *cli.Context) (*webConfig, error) {
+	web := &webConfig{}
+	if filename := c.String("web-config-file"); filename != "" {
+		var err error
+		if web, err = loadWebConfig(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	for flag, value := range map[string]*string{
+		"tls-cert-file":      &web.TLSConfig.CertFile,
+		"tls-key-file":       &web.TLSConfig.KeyFile,
+		"tls-client-ca-file": &web.TLSConfig.ClientCAFile,
+		"bearer-token-file":  &web.BearerTokenFile,
+	} {
+		if v := c.String(flag); v != "" {
+			*value = v
+		}
+	}
+
+	if err := web.init(); err != nil {
+		return nil, err
+	}
+	return web, nil
+}
+
+// ruleProvisioningHandler serves the API of an artifact kind at its path,
+// like the rules API for Prometheus rules:
+//
+//	GET    /api/v1/rules          lists the provisioned rule files
+//	GET    /api/v1/rules/{mixin}  returns the rules of a mixin
+//	PUT    /api/v1/rules/{mixin}  provisions the rules of a mixin
+//	DELETE /api/v1/rules/{mixin}  removes the rules of a mixin
+//	POST   /api/v1/rules/{mixin}/rollback
+//	                              restores the previous rules of a mixin
+//
+// If a reload fails after a change, the previous version is restored.
 type ruleProvisioningHandler struct {
-	ruleProvisioner    *ruleProvisioner
-	prometheusReloader *prometheusReloader
+	kind string
+	path string
+	// maxBodyBytes limits the size of provisioned files, if greater than 0.
+	maxBodyBytes    int64
+	ruleProvisioner *ruleProvisioner
+	reloader        *reloader
+	status          *provisioningStatus
+	metrics         *serverMetrics
+
+	// mtx serializes changes, so that concurrent requests can't interleave
+	// writing files and reloading.
+	mtx sync.Mutex
 }
 
 func (h *ruleProvisioningHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	if r.Method != "PUT" {
-		http.Error(w, "Bad request: only PUT requests supported", http.StatusBadRequest)
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, h.path), "/")
+	if name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Bad request: only GET requests supported", http.StatusBadRequest)
+			return
+		}
+		h.list(w)
+		return
+	}
+
+	action := ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name, action = name[:i], name[i+1:]
+	}
+
+	if !validMixinName.MatchString(name) {
+		http.Error(w, fmt.Sprintf("Bad request: invalid mixin name %q", name), http.StatusBadRequest)
+		return
+	}
+
+	if action != "" {
+		if action != "rollback" || r.Method != "POST" {
+			http.Error(w, "Bad request: only POST requests to rollback supported", http.StatusBadRequest)
+			return
+		}
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+		h.rollback(w, r, name)
 		return
 	}
 
-	reloadNecessary, err := h.ruleProvisioner.provision(r.Body)
+	switch r.Method {
+	case "GET":
+		h.get(w, name)
+	case "PUT":
+		h.put(w, r, name)
+	case "DELETE":
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+		h.delete(w, r, name)
+	default:
+		http.Error(w, "Bad request: only GET, PUT and DELETE requests supported", http.StatusBadRequest)
+	}
+}
+
+func (h *ruleProvisioningHandler) list(w http.ResponseWriter) {
+	files, err := h.ruleProvisioner.list()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Internal Server Error: %v", err), http.StatusInternalServerError)
 		return
 	}
+	writeJSON(w, http.StatusOK, files)
+}
 
-	if reloadNecessary {
-		if err := h.prometheusReloader.triggerReload(ctx); err != nil {
-			http.Error(w, fmt.Sprintf("Internal Server Error: %v", err), http.StatusInternalServerError)
-			return
+func (h *ruleProvisioningHandler) get(w http.ResponseWriter, name string) {
+	content, err := ioutil.ReadFile(h.ruleProvisioner.ruleFile(name))
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Not found: %q is not provisioned", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Internal Server Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(content)
+}
+
+// put reads the body before taking h.mtx, so that slow clients don't block
+// other changes.
+func (h *ruleProvisioningHandler) put(w http.ResponseWriter, r *http.Request, name string) {
+	body := r.Body
+	if h.maxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+	}
+	content, err := ioutil.ReadAll(body)
+	// http.MaxBytesError is only available as of Go 1.19.
+	if err != nil && err.Error() == "http: request body too large" {
+		h.metrics.provisionRequest(h.kind, r.Method, outcomeInvalid)
+		http.Error(w, fmt.Sprintf("Request Entity Too Large: the limit is %d bytes", h.maxBodyBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		h.metrics.provisionRequest(h.kind, r.Method, outcomeError)
+		http.Error(w, fmt.Sprintf("Bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	writeError(w, h.provisionMixin(r.Context(), r.Method, name, bytes.NewReader(content)))
+}
+
+// provisionMixin provisions the file of a mixin read from body and triggers
+// the reload if it changed, restoring the previous version if the reload
+// fails. Callers must hold h.mtx.
+func (h *ruleProvisioningHandler) provisionMixin(ctx context.Context, method, name string, body io.Reader) error {
+	ruleFile := h.ruleProvisioner.ruleFile(name)
+	_, err := os.Stat(ruleFile)
+	existed := err == nil
+
+	reloadNecessary, err := h.ruleProvisioner.provision(name, body)
+	var verr *validationError
+	if errors.As(err, &verr) {
+		h.metrics.provisionRequest(h.kind, method, outcomeInvalid)
+		return err
+	}
+	if err != nil {
+		h.metrics.provisionRequest(h.kind, method, outcomeError)
+		return err
+	}
+
+	if !reloadNecessary {
+		h.metrics.provisionRequest(h.kind, method, outcomeUnchanged)
+		return nil
+	}
+	h.metrics.setRuleFileBytes(h.kind, name, ruleFile)
+	h.status.provisioned()
+	return h.reload(ctx, method, name, func() error {
+		if existed {
+			return h.ruleProvisioner.rollback(name)
 		}
+		return os.Remove(ruleFile)
+	})
+}
+
+func (h *ruleProvisioningHandler) delete(w http.ResponseWriter, r *http.Request, name string) {
+	if err := h.removeMixin(r.Context(), r.Method, name); errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Not found: %q is not provisioned", name), http.StatusNotFound)
+	} else {
+		writeError(w, err)
 	}
 }
 
+// removeMixin removes the file of a mixin and triggers the reload, restoring
+// the file if the reload fails. Callers must hold h.mtx.
+func (h *ruleProvisioningHandler) removeMixin(ctx context.Context, method, name string) error {
+	if err := h.ruleProvisioner.remove(name); errors.Is(err, os.ErrNotExist) {
+		return err
+	} else if err != nil {
+		h.metrics.provisionRequest(h.kind, method, outcomeError)
+		return err
+	}
+	h.metrics.setRuleFileBytes(h.kind, name, h.ruleProvisioner.ruleFile(name))
+	h.status.provisioned()
+	return h.reload(ctx, method, name, func() error {
+		return h.ruleProvisioner.rollback(name)
+	})
+}
+
+func (h *ruleProvisioningHandler) rollback(w http.ResponseWriter, r *http.Request, name string) {
+	// The last version kept to restore failed reloads isn't history.
+	if h.ruleProvisioner.historySize <= 0 {
+		http.Error(w, fmt.Sprintf("Not found: the history of %q is disabled", name), http.StatusNotFound)
+		return
+	}
+	if err := h.ruleProvisioner.rollback(name); errors.Is(err, errNoHistory) {
+		http.Error(w, fmt.Sprintf("Not found: no previous version of %q", name), http.StatusNotFound)
+		return
+	} else if err != nil {
+		h.metrics.provisionRequest(h.kind, r.Method, outcomeError)
+		writeError(w, err)
+		return
+	}
+	h.metrics.setRuleFileBytes(h.kind, name, h.ruleProvisioner.ruleFile(name))
+	h.status.provisioned()
+	writeError(w, h.reload(r.Context(), r.Method, name, nil))
+}
+
+// reload triggers the reload after a change and records the outcome. If the
+// reload fails, restore is called to undo the change, if set. The reload isn't
+// retried after restoring, as the reload targets keep the previous version
+// loaded when a reload fails.
+func (h *ruleProvisioningHandler) reload(ctx context.Context, method, name string, restore func() error) error {
+	err := h.reloader.triggerReload(ctx)
+	h.status.reloaded(err)
+	h.metrics.reloaded(h.kind, err)
+	if err == nil {
+		h.metrics.provisionRequest(h.kind, method, outcomeProvisioned)
+		return nil
+	}
+
+	h.metrics.provisionRequest(h.kind, method, outcomeReloadFailed)
+	if restore == nil {
+		return err
+	}
+	defer h.metrics.setRuleFileBytes(h.kind, name, h.ruleProvisioner.ruleFile(name))
+	if rerr := restore(); rerr != nil {
+		return fmt.Errorf("%v; unable to restore the previous version: %v", err, rerr)
+	}
+	return fmt.Errorf("%v; restored the previous version", err)
+}
+
+// writeError responds with err, if not nil. Validation errors are responded
+// with as JSON and status 400, all others with status 500.
+func writeError(w http.ResponseWriter, err error) {
+	var verr *validationError
+	switch {
+	case err == nil:
+	case errors.As(err, &verr):
+		writeJSON(w, http.StatusBadRequest, verr)
+	default:
+		http.Error(w, fmt.Sprintf("Internal Server Error: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// provisioningStatus records the outcome of the last provisioning and reload.
+// It serves GET /api/v1/status.
+type provisioningStatus struct {
+	mtx    sync.Mutex
+	status statusResponse
+}
+
+type statusResponse struct {
+	LastProvisionTime *time.Time `json:"lastProvisionTime"`
+	LastReloadTime    *time.Time `json:"lastReloadTime"`
+	LastReloadSuccess bool       `json:"lastReloadSuccess"`
+	LastReloadError   string     `json:"lastReloadError,omitempty"`
+}
+
+func (s *provisioningStatus) provisioned() {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status.LastProvisionTime = &now
+}
+
+func (s *provisioningStatus) reloaded(err error) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status.LastReloadTime = &now
+	s.status.LastReloadSuccess = err == nil
+	s.status.LastReloadError = ""
+	if err != nil {
+		s.status.LastReloadError = err.Error()
+	}
+}
+
+func (s *provisioningStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad request: only GET requests supported", http.StatusBadRequest)
+		return
+	}
+	s.mtx.Lock()
+	status := s.status
+	s.mtx.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// validMixinName matches mixin names that are safe to use as file names.
+var validMixinName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ruleFileExt is the extension of the rule files in the rules directory.
+const ruleFileExt = ".yaml"
+
+// tempDir is the directory in the rules directory that new rule files are
+// written to before they are renamed into place. Neither Prometheus, which
+// only loads files with the rule file extension, nor the Loki ruler, which
+// loads all files but no directories, load them from there.
+const tempDir = ".tmp"
+
 type ruleProvisioner struct {
-	ruleFile string
+	rulesDir string
+	// linter validates new rules before they are provisioned, if set.
+	linter mixer.Linter
+	// historySize is the number of previous versions kept of each file.
+	historySize int
 }
 
-// provision attempts to provision the rule files read from r, and if identical
-// to existing, does not provision them. It returns whether Prometheus should
-// be reloaded and if an error has occurred.
-func (p *ruleProvisioner) provision(r io.Reader) (bool, error) {
+// validationError is returned by provision for rules that fail validation.
+// It is encoded as the JSON body of the 400 response.
+type validationError struct {
+	Errors []string `json:"errors"`
+}
+
+func newValidationError(errs []error) *validationError {
+	verr := &validationError{}
+	for _, err := range errs {
+		verr.Errors = append(verr.Errors, err.Error())
+	}
+	return verr
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("invalid rules: %s", strings.Join(e.Errors, "; "))
+}
+
+// ruleFile returns the path of the rule file of the named mixin.
+func (p *ruleProvisioner) ruleFile(name string) string {
+	return filepath.Join(p.rulesDir, name+ruleFileExt)
+}
+
+// provisionedRuleFile describes the rule file of a provisioned mixin.
+type provisionedRuleFile struct {
+	Mixin        string    `json:"mixin"`
+	File         string    `json:"file"`
+	SHA256       string    `json:"sha256"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// list returns the rule files of all provisioned mixins, sorted by name.
+func (p *ruleProvisioner) list() ([]provisionedRuleFile, error) {
+	entries, err := ioutil.ReadDir(p.rulesDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rules directory: %w", err)
+	}
+
+	files := []provisionedRuleFile{}
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ruleFileExt)
+		if e.IsDir() || name == e.Name() || !validMixinName.MatchString(name) {
+			continue
+		}
+
+		file := filepath.Join(p.rulesDir, e.Name())
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read rules file: %w", err)
+		}
+		files = append(files, provisionedRuleFile{
+			Mixin:        name,
+			File:         file,
+			SHA256:       fmt.Sprintf("%x", sha256.Sum256(content)),
+			LastModified: e.ModTime().UTC(),
+		})
+	}
+	return files, nil
+}
+
+// provision attempts to provision the rule files read from r for the named
+// mixin, and if identical to existing, does not provision them. Rules that
+// fail validation are not provisioned and a *validationError is returned. The
+// replaced rule file is kept as previous version. It returns whether
+// Prometheus should be reloaded and if an error has occurred.
+func (p *ruleProvisioner) provision(name string, r io.Reader) (bool, error) {
 	newData, err := ioutil.ReadAll(r)
 	if err != nil {
 		return false, fmt.Errorf("unable to read new rules: %w", err)
 	}
 
-	tempfile, err := ioutil.TempFile(filepath.Dir(p.ruleFile), "temp-mixtool")
+	if p.linter != nil {
+		if errs := p.linter(newData); len(errs) > 0 {
+			return false, newValidationError(errs)
+		}
+	}
+
+	ruleFile := p.ruleFile(name)
+	oldData, err := ioutil.ReadFile(ruleFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("unable to read existing rules: %w", err)
+	}
+	if err == nil {
+		equal, err := readersEqual(bytes.NewReader(newData), bytes.NewReader(oldData))
+		if err != nil {
+			return false, fmt.Errorf("error from readersEqual: %w", err)
+		}
+		if equal {
+			return false, nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(p.rulesDir, tempDir), 0755); err != nil {
+		return false, fmt.Errorf("unable to create temp directory: %w", err)
+	}
+	tempfile, err := ioutil.TempFile(filepath.Join(p.rulesDir, tempDir), "temp-mixtool")
 	if err != nil {
 		return false, fmt.Errorf("unable to create temp file: %w", err)
 	}
+	defer os.Remove(tempfile.Name())
+	defer tempfile.Close()
 
 	n, err := tempfile.Write(newData)
 	if err != nil {
@@ -122,33 +787,27 @@ func (p *ruleProvisioner) provision(r io.Reader) (bool, error) {
 		return false, err
 	}
 
-	ruleFileReader, err := os.OpenFile(p.ruleFile, os.O_RDWR, 0644)
-	if err != nil {
-		return false, fmt.Errorf("unable to read existing rules: %w", err)
-	}
-
-	newFileReader, err := os.OpenFile(tempfile.Name(), os.O_RDWR, 0644)
-	if err != nil {
-		return false, fmt.Errorf("unable to open new rules file: %w", err)
-	}
-
-	equal, err := readersEqual(newFileReader, ruleFileReader)
-	if err != nil {
-		return false, fmt.Errorf("error from readersEqual: %w", err)
-	}
-
-	if equal {
-		return false, nil
+	if err := p.archive(name); err != nil {
+		return false, err
 	}
 
-	if err = os.Rename(tempfile.Name(), p.ruleFile); err != nil {
+	if err = os.Rename(tempfile.Name(), ruleFile); err != nil {
 		return false, fmt.Errorf("cannot rename rules file: %w", err)
 	}
 	return true, nil
 }
 
-type prometheusReloader struct {
-	prometheusReloadURL string
+// remove removes the rule file of the named mixin, keeping it as previous
+// version. It returns an error
+// wrapping os.ErrNotExist if the mixin isn't provisioned.
+func (p *ruleProvisioner) remove(name string) error {
+	if err := p.archive(name); err != nil {
+		return err
+	}
+	if err := os.Remove(p.ruleFile(name)); err != nil {
+		return fmt.Errorf("cannot remove rules file: %w", err)
+	}
+	return nil
 }
 
 func readersEqual(r1, r2 io.Reader) (bool, error) {
@@ -172,8 +831,50 @@ func readersEqual(r1, r2 io.Reader) (bool, error) {
 	}
 }
 
-func (r *prometheusReloader) triggerReload(ctx context.Context) error {
-	req, err := http.NewRequest("POST", r.prometheusReloadURL, nil)
+// reloadTarget is an endpoint to request after provisioning, like the
+// /-/reload endpoint of Prometheus.
+type reloadTarget struct {
+	URL    string
+	Method string
+	// Status is the expected status code of the response.
+	Status int
+}
+
+// parseReloadTarget parses the value of a --reload-target flag into the name
+// of the artifact kind and the target.
+func parseReloadTarget(s string) (string, reloadTarget, error) {
+	var kind string
+	t := reloadTarget{Method: "POST", Status: http.StatusOK}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return "", t, fmt.Errorf("reload target %q: expected key=value, got %q", s, field)
+		}
+		switch kv[0] {
+		case "kind":
+			kind = kv[1]
+		case "url":
+			t.URL = kv[1]
+		case "method":
+			t.Method = strings.ToUpper(kv[1])
+		case "status":
+			status, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return "", t, fmt.Errorf("reload target %q: invalid status: %w", s, err)
+			}
+			t.Status = status
+		default:
+			return "", t, fmt.Errorf("reload target %q: unknown key %q", s, kv[0])
+		}
+	}
+	if kind == "" || t.URL == "" {
+		return "", t, fmt.Errorf("reload target %q: kind and url are required", s)
+	}
+	return kind, t, nil
+}
+
+func (t reloadTarget) reload(ctx context.Context) error {
+	req, err := http.NewRequest(t.Method, t.URL, nil)
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}
@@ -183,13 +884,33 @@ func (r *prometheusReloader) triggerReload(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("reload request: %w", err)
 	}
+	defer resp.Body.Close()
 
 	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
 		return fmt.Errorf("exhausting request body: %w", err)
 	}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("received non-200 response: %s; have you set `--web.enable-lifecycle` Prometheus flag?", resp.Status)
+	if resp.StatusCode != t.Status {
+		return fmt.Errorf("%s %s: received %s, expected %d; have you enabled the lifecycle API, like the `--web.enable-lifecycle` Prometheus flag?", t.Method, t.URL, resp.Status, t.Status)
+	}
+	return nil
+}
+
+// reloader requests the reload targets of an artifact kind.
+type reloader struct {
+	targets []reloadTarget
+}
+
+// triggerReload requests all targets, returning the errors of the failed ones.
+func (r *reloader) triggerReload(ctx context.Context) error {
+	var errs []string
+	for _, t := range r.targets {
+		if err := t.reload(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
 	}
 	return nil
 }
@@ -0,0 +1,408 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+const existingRules = `groups:
+- name: existing
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+`
+
+func newTestRuleProvisioningHandler(t *testing.T) (*ruleProvisioningHandler, string, *int) {
+	dir := t.TempDir()
+	ruleFile := filepath.Join(dir, "existing.yaml")
+	if err := ioutil.WriteFile(ruleFile, []byte(existingRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := 0
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reloads++
+	}))
+	t.Cleanup(prometheus.Close)
+
+	return &ruleProvisioningHandler{
+		ruleProvisioner: &ruleProvisioner{
+			rulesDir: dir,
+			linter:   mixer.NewPrometheusLinter(),
+		},
+		path: "/api/v1/rules",
+		reloader: &reloader{targets: []reloadTarget{
+			{URL: prometheus.URL + "/-/reload", Method: "POST", Status: http.StatusOK},
+		}},
+		status: &provisioningStatus{},
+	}, ruleFile, &reloads
+}
+
+func TestRuleProvisioningValid(t *testing.T) {
+	h, ruleFile, reloads := newTestRuleProvisioningHandler(t)
+
+	rules := strings.Replace(existingRules, "existing", "new", 1)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/existing", strings.NewReader(rules)))
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 1, *reloads)
+	content, err := ioutil.ReadFile(ruleFile)
+	assert.NoError(t, err)
+	assert.Equal(t, rules, string(content))
+}
+
+func TestRuleProvisioningInvalid(t *testing.T) {
+	h, ruleFile, reloads := newTestRuleProvisioningHandler(t)
+
+	for _, rules := range []string{
+		"groups:\n- name: broken\n  rules:\n  - record: job:up:sum\n    expr: sum by (job) (up\n",
+		"not: [yaml",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/existing", strings.NewReader(rules)))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var verr validationError
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &verr))
+		assert.NotEmpty(t, verr.Errors)
+	}
+
+	assert.Equal(t, 0, *reloads)
+	content, err := ioutil.ReadFile(ruleFile)
+	assert.NoError(t, err)
+	assert.Equal(t, existingRules, string(content))
+}
+
+func TestRuleProvisioningPerMixin(t *testing.T) {
+	h, ruleFile, reloads := newTestRuleProvisioningHandler(t)
+	dir := filepath.Dir(ruleFile)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/other", strings.NewReader(existingRules)))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 1, *reloads)
+
+	// Provisioning the same rules again doesn't reload Prometheus.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/other", strings.NewReader(existingRules)))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 1, *reloads)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/rules", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var files []provisionedRuleFile
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &files))
+	if assert.Len(t, files, 2) {
+		for i, mixin := range []string{"existing", "other"} {
+			assert.Equal(t, mixin, files[i].Mixin)
+			assert.Equal(t, filepath.Join(dir, mixin+".yaml"), files[i].File)
+			assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte(existingRules))), files[i].SHA256)
+			assert.False(t, files[i].LastModified.IsZero())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/rules/other", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, existingRules, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/rules/other", nil))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 2, *reloads)
+	_, err := os.Stat(filepath.Join(dir, "other.yaml"))
+	assert.True(t, os.IsNotExist(err))
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/api/v1/rules/other", nil),
+		httptest.NewRequest("DELETE", "/api/v1/rules/other", nil),
+	} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/..", strings.NewReader(existingRules)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The existing mixin is untouched.
+	content, err := ioutil.ReadFile(ruleFile)
+	assert.NoError(t, err)
+	assert.Equal(t, existingRules, string(content))
+}
+
+func TestProvisioningStatus(t *testing.T) {
+	h, _, _ := newTestRuleProvisioningHandler(t)
+
+	status := func() statusResponse {
+		w := httptest.NewRecorder()
+		h.status.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/status", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var s statusResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &s))
+		return s
+	}
+
+	s := status()
+	assert.Nil(t, s.LastProvisionTime)
+	assert.Nil(t, s.LastReloadTime)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/other", strings.NewReader(existingRules)))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	s = status()
+	assert.NotNil(t, s.LastProvisionTime)
+	assert.NotNil(t, s.LastReloadTime)
+	assert.True(t, s.LastReloadSuccess)
+	assert.Empty(t, s.LastReloadError)
+
+	h.reloader.targets[0].URL = "http://127.0.0.1:0/-/reload"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/rules/other", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	s = status()
+	assert.False(t, s.LastReloadSuccess)
+	assert.Contains(t, s.LastReloadError, "reload request")
+}
+
+func TestParseReloadTarget(t *testing.T) {
+	kind, target, err := parseReloadTarget("kind=loki,url=http://loki:3100/ruler/reload,method=get,status=204")
+	assert.NoError(t, err)
+	assert.Equal(t, "loki", kind)
+	assert.Equal(t, reloadTarget{URL: "http://loki:3100/ruler/reload", Method: "GET", Status: http.StatusNoContent}, target)
+
+	kind, target, err = parseReloadTarget("kind=alertmanager,url=http://alertmanager:9093/-/reload")
+	assert.NoError(t, err)
+	assert.Equal(t, "alertmanager", kind)
+	assert.Equal(t, reloadTarget{URL: "http://alertmanager:9093/-/reload", Method: "POST", Status: http.StatusOK}, target)
+
+	for _, invalid := range []string{
+		"url=http://prometheus:9090/-/reload",
+		"kind=prometheus",
+		"kind=prometheus,url=http://prometheus:9090/-/reload,status=ok",
+		"kind=prometheus,url=http://prometheus:9090/-/reload,timeout=5s",
+		"prometheus",
+	} {
+		_, _, err := parseReloadTarget(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestServerArtifactKindsRuleFile(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range serverCommand().Flags {
+		f.Apply(set)
+	}
+	assert.NoError(t, set.Set("rule-file", "/etc/prometheus/rules/mixins.yaml"))
+
+	_, err := serverArtifactKinds(cli.NewContext(nil, set, nil))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--rules-dir")
+	}
+}
+
+func TestReloaderAllTargets(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	r := &reloader{targets: []reloadTarget{
+		{URL: srv.URL + "/fail", Method: "POST", Status: http.StatusOK},
+		{URL: srv.URL + "/-/reload", Method: "PUT", Status: http.StatusOK},
+	}}
+	err := r.triggerReload(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "403 Forbidden")
+	assert.Equal(t, []string{"POST /fail", "PUT /-/reload"}, requests)
+}
+
+func TestAlertmanagerProvisioning(t *testing.T) {
+	h := &ruleProvisioningHandler{
+		path: "/api/v1/alertmanager/configs",
+		ruleProvisioner: &ruleProvisioner{
+			rulesDir: t.TempDir(),
+			linter:   mixer.NewAlertmanagerLinter(),
+		},
+		reloader: &reloader{},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/alertmanager/configs/alertmanager", strings.NewReader("route:\n  receiver: default\nreceivers:\n- name: default\n")))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/alertmanager/configs/alertmanager", strings.NewReader("route:\n  receiver: missing\n")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRuleProvisioningMaxBodyBytes(t *testing.T) {
+	h, ruleFile, reloads := newTestRuleProvisioningHandler(t)
+	h.maxBodyBytes = int64(len(existingRules))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/other", strings.NewReader(existingRules)))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/existing", strings.NewReader(existingRules+"\n")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	assert.Equal(t, 1, *reloads)
+	content, err := ioutil.ReadFile(ruleFile)
+	assert.NoError(t, err)
+	assert.Equal(t, existingRules, string(content))
+}
+
+func TestRuleProvisioningConcurrent(t *testing.T) {
+	h, ruleFile, _ := newTestRuleProvisioningHandler(t)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rules := strings.Replace(existingRules, "existing", fmt.Sprintf("group-%d", i), 1)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/existing", strings.NewReader(rules)))
+			codes <- w.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	content, err := ioutil.ReadFile(ruleFile)
+	assert.NoError(t, err)
+	assert.Regexp(t, `name: group-\d\n`, string(content))
+
+	// Temp files are written outside of the files the rulers load, and none
+	// are left behind.
+	entries, err := ioutil.ReadDir(filepath.Dir(ruleFile))
+	assert.NoError(t, err)
+	for _, e := range entries {
+		if !e.IsDir() {
+			assert.Equal(t, "existing.yaml", e.Name())
+		}
+	}
+	entries, err = ioutil.ReadDir(filepath.Join(filepath.Dir(ruleFile), tempDir))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRuleProvisioningSlowClient(t *testing.T) {
+	h, _, _ := newTestRuleProvisioningHandler(t)
+
+	// A client that doesn't finish sending its body doesn't block others.
+	body, sender := io.Pipe()
+	defer sender.Close()
+	slow := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/rules/slow", body))
+		slow <- w.Code
+	}()
+	sender.Write([]byte("groups:\n"))
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/rules/existing", nil))
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("DELETE blocked by a slow PUT")
+	}
+
+	sender.Close()
+	assert.Equal(t, http.StatusOK, <-slow)
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve(ctx, srv, time.Minute, func() error { return srv.Serve(l) })
+	}()
+
+	respc := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			respc <- 0
+			return
+		}
+		resp.Body.Close()
+		respc <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+	// The in-flight request is finished before serve returns.
+	select {
+	case err := <-errc:
+		t.Fatalf("serve returned before the in-flight request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(finish)
+
+	assert.Equal(t, http.StatusOK, <-respc)
+	assert.NoError(t, <-errc)
+}
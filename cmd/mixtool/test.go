@@ -0,0 +1,72 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"github.com/urfave/cli"
+)
+
+func testCommand() cli.Command {
+	return cli.Command{
+		Name:        "test",
+		Usage:       "Unit test rules and alerts",
+		Description: "Unit test the Prometheus or Loki rules and alerts of a mixin with promtool-style test files",
+		ArgsUsage:   "<mixin.libsonnet> <test-file>...",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "jpath, J",
+				Usage: "Add folders to be used as vendor folders",
+			},
+			cli.StringFlag{
+				Name:  "data-source, s",
+				Usage: "The source the rules, alerts and test files are written for (loki,prometheus)",
+				Value: "prometheus",
+			},
+		},
+		Action: testAction,
+	}
+}
+
+func testAction(c *cli.Context) error {
+	filename := c.Args().First()
+	if filename == "" {
+		return fmt.Errorf("expected the mixin filename followed by test files")
+	}
+
+	testFiles := c.Args().Tail()
+	if len(testFiles) == 0 {
+		return fmt.Errorf("expected at least one test file")
+	}
+
+	jPath := c.StringSlice("jpath")
+	jPath, err := availableVendor(filename, jPath)
+	if err != nil {
+		return err
+	}
+
+	options := mixer.TestOptions{
+		JPaths:     jPath,
+		DataSource: mixer.DataSource(c.String("data-source")),
+	}
+
+	if err := mixer.Test(os.Stdout, filename, testFiles, options); err != nil {
+		return fmt.Errorf("failed to test the file %s: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/monitoring-mixins/mixtool/pkg/jsonnetbundler"
+	"github.com/urfave/cli"
+)
+
+func uninstallCommand() cli.Command {
+	return cli.Command{
+		Name:        "uninstall",
+		Usage:       "Uninstall a mixin",
+		Description: "Uninstall a mixin from the directory it has been installed into, removing it from jsonnetfile.json and the vendor directory, and removing its generated outputs",
+		ArgsUsage:   "<name>",
+		Action:      uninstallAction,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "bind-address",
+				Usage: "Address of the mixtool server.",
+				Value: "http://127.0.0.1:8080",
+			},
+			cli.StringFlag{
+				Name:  "directory, d",
+				Usage: "Path the mixin has been installed into",
+			},
+			cli.BoolFlag{
+				Name:  "delete",
+				Usage: "Specify this flag when you want to send DELETE requests to the mixtool server to remove the rules of the mixin",
+			},
+		}, httpClientFlags("the mixtool server")...),
+	}
+}
+
+func uninstallAction(c *cli.Context) error {
+	directory := c.String("directory")
+	if directory == "" {
+		return fmt.Errorf("Must specify the directory the mixin has been installed into")
+	}
+
+	name := c.Args().First()
+	if name == "" {
+		return fmt.Errorf("Expected the name of the mixin to uninstall")
+	}
+
+	ws, err := loadWorkspace(directory)
+	if err != nil {
+		return err
+	}
+	m := ws.mixin(name)
+	if m == nil {
+		return fmt.Errorf("mixin %s is not installed in %s", name, directory)
+	}
+
+	// remove the rules from the server first, so that the mixin is still
+	// installed to retry if that fails
+	if c.Bool("delete") {
+		client, err := newHTTPClient(c)
+		if err != nil {
+			return err
+		}
+		for _, apiPath := range []string{"/api/v1/rules", "/api/v1/loki/rules"} {
+			if err := deleteMixin(client, c.String("bind-address"), apiPath, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return uninstallMixin(ws, name)
+}
+
+// uninstallMixin removes an installed mixin, its sources unless other
+// mixins share them, like the clone of a repository at the same ref, and its
+// generated outputs from a workspace.
+func uninstallMixin(ws *workspace, name string) error {
+	m := *ws.mixin(name)
+	ws.remove(name)
+
+	switch {
+	case strings.HasPrefix(m.Source, gitFileScheme):
+		clone := gitFileClone(ws.dir, m.Source)
+		shared := false
+		for _, other := range ws.config.Mixins {
+			if strings.HasPrefix(other.Source, gitFileScheme) && gitFileClone(ws.dir, other.Source) == clone {
+				shared = true
+			}
+		}
+		if !shared {
+			if err := os.RemoveAll(clone); err != nil {
+				return err
+			}
+		}
+	case !isLocal(m):
+		if err := jsonnetbundler.UninstallCommand(ws.dir, "vendor", []string{m.Source}); err != nil {
+			return fmt.Errorf("jsonnet bundler uninstall failed %v", err)
+		}
+	}
+
+	if m.Output != "" {
+		if err := os.RemoveAll(ws.path(m.Output)); err != nil {
+			return fmt.Errorf("removing outputs: %w", err)
+		}
+	}
+
+	return ws.write()
+}
+
+// deleteMixin removes the rules of a mixin from the mixtool server. Rules
+// that aren't provisioned, like Loki rules of a mixin without any, are fine.
+func deleteMixin(client *http.Client, bindAddress string, apiPath string, name string) error {
+	u, err := url.Parse(bindAddress)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, apiPath, name)
+
+	req, err := http.NewRequest("DELETE", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("response from server %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fmt.Printf("DELETE %s OK\n", apiPath)
+	case http.StatusNotFound:
+	default:
+		responseData, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response body in deleteMixin, %w", err)
+		}
+		return fmt.Errorf("non 200 response code: %d, info: %s", resp.StatusCode, string(responseData))
+	}
+	return nil
+}
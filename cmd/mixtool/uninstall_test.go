@@ -0,0 +1,77 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestUninstallMixin(t *testing.T) {
+	repo := newTestGitRepo(t)
+	gitCommit(t, repo, testPullMixin, "v1")
+
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local-mixin")
+	if err := os.Mkdir(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, local, "mixin.libsonnet", testPullMixin)
+
+	workspace := filepath.Join(dir, "workspace")
+	out := filepath.Join(dir, "out")
+	app := cli.NewApp()
+	app.Commands = cli.Commands{installCommand(), uninstallCommand()}
+	for _, src := range []string{gitFileScheme + repo + "//example-mixin", local} {
+		assert.NoError(t, app.Run([]string{"mixtool", "install", "-d", workspace, "-o", out, src}))
+	}
+
+	// The server has Prometheus rules of the mixin, but no Loki rules.
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path != "/api/v1/rules/example-mixin" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	assert.NoError(t, app.Run([]string{"mixtool", "uninstall", "-d", workspace, "--delete", "--bind-address", srv.URL, "example-mixin"}))
+	assert.Equal(t, []string{"DELETE /api/v1/rules/example-mixin", "DELETE /api/v1/loki/rules/example-mixin"}, requests)
+
+	for _, removed := range []string{filepath.Join(out, "example-mixin"), filepath.Join(workspace, gitDir, filepath.Base(repo))} {
+		_, err := os.Stat(removed)
+		assert.True(t, os.IsNotExist(err), removed)
+	}
+	_, err := os.Stat(filepath.Join(out, "local-mixin"))
+	assert.NoError(t, err)
+	// Local mixins are left alone.
+	_, err = os.Stat(filepath.Join(local, "mixin.libsonnet"))
+	assert.NoError(t, err)
+
+	ws, err := loadWorkspace(workspace)
+	assert.NoError(t, err)
+	assert.Nil(t, ws.mixin("example-mixin"))
+	assert.NotNil(t, ws.mixin("local-mixin"))
+
+	assert.Error(t, app.Run([]string{"mixtool", "uninstall", "-d", workspace, "example-mixin"}))
+	assert.NoError(t, app.Run([]string{"mixtool", "uninstall", "-d", workspace, "local-mixin"}))
+}
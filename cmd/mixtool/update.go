@@ -0,0 +1,157 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/monitoring-mixins/mixtool/pkg/jsonnetbundler"
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"github.com/urfave/cli"
+)
+
+func updateCommand() cli.Command {
+	return cli.Command{
+		Name:        "update",
+		Usage:       "Update installed mixins",
+		Description: "Update the mixins installed into a directory to the latest version of their ref, regenerate their outputs with the options they have been installed with and print the alerts, recording rules and dashboards that changed. Updates all mixins if no name is given",
+		ArgsUsage:   "[name...]",
+		Action:      updateAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "directory, d",
+				Usage: "Path the mixins have been installed into",
+			},
+		},
+	}
+}
+
+func updateAction(c *cli.Context) error {
+	directory := c.String("directory")
+	if directory == "" {
+		return fmt.Errorf("Must specify the directory the mixins have been installed into")
+	}
+
+	ws, err := loadWorkspace(directory)
+	if err != nil {
+		return err
+	}
+	return updateMixins(os.Stdout, ws, c.Args())
+}
+
+// updateMixins updates the named mixins of a workspace, or all if no names
+// are given, regenerates their outputs and prints their changes to w.
+func updateMixins(w io.Writer, ws *workspace, names []string) error {
+	var mixins []mixinConfig
+	if len(names) == 0 {
+		mixins = ws.config.Mixins
+	}
+	for _, name := range names {
+		m := ws.mixin(name)
+		if m == nil {
+			return fmt.Errorf("mixin %s is not installed in %s", name, ws.dir)
+		}
+		mixins = append(mixins, *m)
+	}
+	if len(mixins) == 0 {
+		return fmt.Errorf("no mixins installed in %s", ws.dir)
+	}
+
+	old := make([]*mixinOutput, len(mixins))
+	for i, m := range mixins {
+		out, err := ws.evalMixinOutput(m)
+		if err != nil {
+			return fmt.Errorf("evaluating installed mixin %s: %w", m.Name, err)
+		}
+		old[i] = out
+	}
+
+	// Mixins installed with jsonnet-bundler are updated at once, mixins
+	// from git+file:// repositories are cloned again and local directories
+	// are evaluated in place, so there's nothing to update.
+	var uris []string
+	for _, m := range mixins {
+		switch {
+		case strings.HasPrefix(m.Source, gitFileScheme):
+			if _, err := fetchGitFileMixin(ws.dir, m.Source); err != nil {
+				return fmt.Errorf("updating mixin %s: %w", m.Name, err)
+			}
+		case !isLocal(m):
+			uris = append(uris, m.Source)
+		}
+	}
+	if len(uris) > 0 {
+		if err := jsonnetbundler.UpdateCommand(ws.dir, "vendor", uris); err != nil {
+			return fmt.Errorf("jsonnet bundler update failed %v", err)
+		}
+	}
+
+	for i, m := range mixins {
+		out, err := ws.evalMixinOutput(m)
+		if err != nil {
+			return fmt.Errorf("evaluating updated mixin %s: %w", m.Name, err)
+		}
+
+		importPath, jpath, err := ws.resolve(m)
+		if err != nil {
+			return err
+		}
+		opts := m.generateOptions()
+		opts.dir = ws.path(m.Output)
+		if _, err := generateMixin(newGenerateConfig(importPath, jpath, opts)); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s:\n", m.Name)
+		if isLocal(m) {
+			fmt.Fprintln(w, "  local directory, changes are not tracked")
+			continue
+		}
+		printChanges(w, compareMixinOutputs(old[i], out))
+	}
+	return nil
+}
+
+// resolve returns the import path and jpath of an installed mixin.
+func (w *workspace) resolve(m mixinConfig) (string, []string, error) {
+	importPath := w.path(m.Path)
+	jpath := make([]string, len(m.JPaths))
+	for i, p := range m.JPaths {
+		jpath[i] = w.path(p)
+	}
+	jpath, err := availableVendor(importPath, jpath)
+	return importPath, jpath, err
+}
+
+func (w *workspace) evalMixinOutput(m mixinConfig) (*mixinOutput, error) {
+	importPath, jpath, err := w.resolve(m)
+	if err != nil {
+		return nil, err
+	}
+	opts := m.generateOptions()
+	return evalMixinOutput(mixer.NewEvaluatorWithExtVars(jpath, opts.extVars), importPath, opts.config)
+}
+
+// isLocal returns whether a mixin has been installed from a local directory.
+func isLocal(m mixinConfig) bool {
+	if m.Source == "" {
+		return true
+	}
+	fi, err := os.Stat(m.Source)
+	return err == nil && fi.IsDir()
+}
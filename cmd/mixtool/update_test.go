@@ -0,0 +1,126 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+const testUpdateMixinV1 = `{
+  prometheusAlerts+:: {
+    groups+: [{
+      name: 'example',
+      rules: [
+        { alert: 'ExampleDown', expr: 'up == 0', 'for': '5m', labels: { severity: 'warning' } },
+        { alert: 'ExampleFlapping', expr: 'changes(up[10m]) > 2' },
+      ],
+    }],
+  },
+  prometheusRules+:: {
+    groups+: [{
+      name: 'example.rules',
+      rules: [
+        { record: 'job:up:sum', expr: 'sum by (job) (up)' },
+        { record: 'job:up:count', expr: 'count by (job) (up)' },
+      ],
+    }],
+  },
+  grafanaDashboards+:: {
+    'example.json': { title: 'Example', panels: [] },
+  },
+}
+`
+
+// testUpdateMixinV2 reformats one expression, changes an alert, removes one
+// and adds a dashboard.
+const testUpdateMixinV2 = `{
+  prometheusAlerts+:: {
+    groups+: [{
+      name: 'example',
+      rules: [
+        { alert: 'ExampleDown', expr: 'up{job!=""} == 0', 'for': '15m', labels: { severity: 'critical', team: 'sre' } },
+      ],
+    }],
+  },
+  prometheusRules+:: {
+    groups+: [{
+      name: 'example.rules',
+      rules: [
+        { record: 'job:up:sum', expr: 'sum  by(job)(up)' },
+        { record: 'job:up:count', expr: 'count by (job, instance) (up)' },
+      ],
+    }],
+  },
+  grafanaDashboards+:: {
+    'example.json': { title: 'Example', panels: [] },
+    'overview.json': { title: 'Overview', panels: [] },
+  },
+}
+`
+
+func TestUpdateMixins(t *testing.T) {
+	repo := newTestGitRepo(t)
+	gitCommit(t, repo, testUpdateMixinV1, "v1")
+
+	dir := t.TempDir()
+	workspace := filepath.Join(dir, "workspace")
+	out := filepath.Join(dir, "out")
+	app := cli.NewApp()
+	app.Commands = cli.Commands{installCommand()}
+	assert.NoError(t, app.Run([]string{"mixtool", "install", "-d", workspace, "-o", out, "--yaml=false", "--pattern", "example", "-V", "cluster=eu", gitFileScheme + repo + "//example-mixin"}))
+
+	gitCommit(t, repo, testUpdateMixinV2, "v2")
+
+	// update generates the outputs with the options of install.
+	ws, err := loadWorkspace(workspace)
+	assert.NoError(t, err)
+	assert.Equal(t, &outputOptions{Pattern: "example", ExtStr: map[string]string{"cluster": "eu"}}, ws.mixin("example-mixin").Options)
+	var report bytes.Buffer
+	assert.NoError(t, updateMixins(&report, ws, nil))
+	assert.Equal(t, `example-mixin:
+  ~ alert ExampleDown
+      expr:
+        - up == 0
+        + up{job!=""} == 0
+      for: 5m -> 15m
+      labels: severity: warning -> critical, +team=sre
+  - alert ExampleFlapping
+  ~ recording rule job:up:count
+      expr:
+        - count by(job) (up)
+        + count by(job, instance) (up)
+  + dashboard overview.json
+`, report.String())
+
+	_, err = os.Stat(filepath.Join(out, "example-mixin", "dashboard", "overview.json"))
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(out, "example-mixin", "prom-example.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `"team": "sre"`)
+
+	// Nothing changed since.
+	report.Reset()
+	assert.NoError(t, updateMixins(&report, ws, []string{"example-mixin"}))
+	assert.Equal(t, "example-mixin:\n  no changes\n", report.String())
+
+	assert.Error(t, updateMixins(&report, ws, []string{"unknown-mixin"}))
+}
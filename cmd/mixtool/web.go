@@ -0,0 +1,188 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// webConfig configures TLS and authentication of the server. The file format
+// follows the web configuration file of the Prometheus exporter-toolkit, with
+// the addition of bearer tokens:
+//
+//	tls_server_config:
+//	  cert_file: server.crt
+//	  key_file: server.key
+//	  client_ca_file: ca.crt
+//	basic_auth_users:
+//	  alice: <bcrypt hash>
+//	bearer_token_file: token
+type webConfig struct {
+	TLSConfig       tlsServerConfig   `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+
+	bearerToken string
+}
+
+type tlsServerConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuthType defaults to RequireAndVerifyClientCert if a client CA
+	// is given, and to NoClientCert otherwise.
+	ClientAuthType string `yaml:"client_auth_type"`
+}
+
+// loadWebConfig reads the web configuration file. Relative paths in the file
+// are resolved against its directory.
+func loadWebConfig(filename string) (*webConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var c webConfig
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parsing web config %s: %w", filename, err)
+	}
+
+	dir := filepath.Dir(filename)
+	for _, path := range []*string{&c.TLSConfig.CertFile, &c.TLSConfig.KeyFile, &c.TLSConfig.ClientCAFile, &c.BearerTokenFile} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	return &c, nil
+}
+
+// init validates the configuration and reads the bearer token.
+func (c *webConfig) init() error {
+	if (c.TLSConfig.CertFile == "") != (c.TLSConfig.KeyFile == "") {
+		return fmt.Errorf("both a TLS certificate and key file are required")
+	}
+	if c.TLSConfig.ClientCAFile != "" && c.TLSConfig.CertFile == "" {
+		return fmt.Errorf("a client CA requires a TLS certificate and key file")
+	}
+	if c.BearerTokenFile != "" {
+		token, err := readSecretFile(c.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("reading bearer token: %w", err)
+		}
+		c.bearerToken = token
+	}
+	return nil
+}
+
+// tls returns the TLS configuration of the server, or nil if TLS is disabled.
+func (c *webConfig) tls() (*tls.Config, error) {
+	if c.TLSConfig.CertFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSConfig.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(c.TLSConfig.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.TLSConfig.ClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	switch c.TLSConfig.ClientAuthType {
+	case "":
+	case "NoClientCert":
+		cfg.ClientAuth = tls.NoClientCert
+	case "RequestClientCert":
+		cfg.ClientAuth = tls.RequestClientCert
+	case "RequireAnyClientCert":
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	case "VerifyClientCertIfGiven":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "RequireAndVerifyClientCert":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client_auth_type %q", c.TLSConfig.ClientAuthType)
+	}
+	return cfg, nil
+}
+
+// authenticate wraps next to require a valid bearer token or basic auth
+// credentials, if any are configured.
+func (c *webConfig) authenticate(next http.Handler) http.Handler {
+	if c.bearerToken == "" && len(c.BasicAuthUsers) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(c.BasicAuthUsers) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mixtool"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (c *webConfig) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if c.bearerToken != "" && strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(c.bearerToken)) == 1
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := c.BasicAuthUsers[user]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// readSecretFile reads a secret like a token or password from a file,
+// trimming surrounding whitespace.
+func readSecretFile(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", filename)
+	}
+	return secret, nil
+}
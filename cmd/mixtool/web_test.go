@@ -0,0 +1,129 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "token", "secret\n")
+	filename := writeFile(t, dir, "web.yaml", `
+tls_server_config:
+  cert_file: server.crt
+  key_file: /etc/mixtool/server.key
+bearer_token_file: token
+`)
+
+	c, err := loadWebConfig(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "server.crt"), c.TLSConfig.CertFile)
+	assert.Equal(t, "/etc/mixtool/server.key", c.TLSConfig.KeyFile)
+	assert.NoError(t, c.init())
+	assert.Equal(t, "secret", c.bearerToken)
+
+	filename = writeFile(t, dir, "unknown.yaml", "tls_config: {}\n")
+	_, err = loadWebConfig(filename)
+	assert.Error(t, err)
+
+	c = &webConfig{TLSConfig: tlsServerConfig{CertFile: "server.crt"}}
+	assert.Error(t, c.init())
+}
+
+func TestWebConfigAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	c := &webConfig{
+		BasicAuthUsers: map[string]string{"alice": string(hash)},
+		bearerToken:    "secret",
+	}
+	h := c.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name      string
+		authorize func(r *http.Request)
+		code      int
+	}{
+		{name: "none", authorize: func(r *http.Request) {}, code: http.StatusUnauthorized},
+		{name: "bearer", authorize: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, code: http.StatusOK},
+		{name: "wrong bearer", authorize: func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, code: http.StatusUnauthorized},
+		{name: "basic", authorize: func(r *http.Request) { r.SetBasicAuth("alice", "password") }, code: http.StatusOK},
+		{name: "wrong password", authorize: func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, code: http.StatusUnauthorized},
+		{name: "unknown user", authorize: func(r *http.Request) { r.SetBasicAuth("bob", "password") }, code: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/rules", nil)
+		test.authorize(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, test.code, w.Code, test.name)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	c := &webConfig{bearerToken: "secret"}
+	srv := httptest.NewUnstartedServer(c.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ca := writeFile(t, dir, "ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	token := writeFile(t, dir, "token", "secret")
+
+	for _, test := range []struct {
+		flags map[string]string
+		code  int
+	}{
+		{flags: map[string]string{"tls-ca-file": ca}, code: http.StatusUnauthorized},
+		{flags: map[string]string{"tls-ca-file": ca, "bearer-token-file": token}, code: http.StatusOK},
+	} {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		for _, f := range httpClientFlags("the mixtool server") {
+			f.Apply(set)
+		}
+		for name, value := range test.flags {
+			assert.NoError(t, set.Set(name, value))
+		}
+
+		client, err := newHTTPClient(cli.NewContext(nil, set, nil))
+		assert.NoError(t, err)
+		resp, err := client.Get(srv.URL + "/api/v1/rules")
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, test.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/monitoring-mixins/mixtool/pkg/mixer"
+	"gopkg.in/yaml.v3"
+)
+
+// workspaceFile is the file in the directory mixins are installed into that
+// tracks the installed mixins. It is a mixins configuration, so that the
+// server can render the installed mixins with --mixins.
+const workspaceFile = "mixtool.yaml"
+
+// workspace is a directory mixins are installed into.
+type workspace struct {
+	dir    string
+	config *mixinsConfig
+}
+
+// outputOptions are the output options a mixin has been installed with, so
+// that update generates its outputs the same way.
+type outputOptions struct {
+	DataSources []string          `yaml:"data_sources,omitempty"`
+	YAML        bool              `yaml:"yaml"`
+	Pattern     string            `yaml:"pattern,omitempty"`
+	ExtStr      map[string]string `yaml:"ext_str,omitempty"`
+	ExtCode     map[string]string `yaml:"ext_code,omitempty"`
+	Config      string            `yaml:"config,omitempty"`
+}
+
+func newOutputOptions(opts generateOptions) *outputOptions {
+	return &outputOptions{
+		DataSources: opts.dataSources,
+		YAML:        opts.yaml,
+		Pattern:     opts.pattern,
+		ExtStr:      opts.extVars.Str,
+		ExtCode:     opts.extVars.Code,
+		Config:      opts.config,
+	}
+}
+
+// generateOptions returns the options an installed mixin is generated with,
+// apart from the output directory. Mixins installed before the options were
+// stored get the defaults of install.
+func (m mixinConfig) generateOptions() generateOptions {
+	o := m.Options
+	if o == nil {
+		o = &outputOptions{YAML: true, Pattern: "rules-alerts"}
+	}
+	return generateOptions{
+		dataSources: o.DataSources,
+		yaml:        o.YAML,
+		pattern:     o.Pattern,
+		extVars:     mixer.ExtVars{Str: o.ExtStr, Code: o.ExtCode},
+		config:      o.Config,
+	}
+}
+
+// loadWorkspace reads the workspace file of dir, if there is one.
+func loadWorkspace(dir string) (*workspace, error) {
+	c, err := readMixinsConfig(filepath.Join(dir, workspaceFile))
+	if errors.Is(err, os.ErrNotExist) {
+		c, err = &mixinsConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &workspace{dir: dir, config: c}, nil
+}
+
+// mixin returns the installed mixin with the given name, or nil.
+func (w *workspace) mixin(name string) *mixinConfig {
+	for i := range w.config.Mixins {
+		if w.config.Mixins[i].Name == name {
+			return &w.config.Mixins[i]
+		}
+	}
+	return nil
+}
+
+// add adds an installed mixin, replacing one of the same name. Paths are
+// stored relative to the workspace, like the server resolves them.
+func (w *workspace) add(m mixinConfig) error {
+	var err error
+	if m.Path, err = w.rel(m.Path); err != nil {
+		return err
+	}
+	if m.Output, err = w.rel(m.Output); err != nil {
+		return err
+	}
+	for i := range m.JPaths {
+		if m.JPaths[i], err = w.rel(m.JPaths[i]); err != nil {
+			return err
+		}
+	}
+
+	if existing := w.mixin(m.Name); existing != nil {
+		*existing = m
+		return nil
+	}
+	w.config.Mixins = append(w.config.Mixins, m)
+	return nil
+}
+
+// remove removes the installed mixin with the given name, returning false if
+// there is none.
+func (w *workspace) remove(name string) bool {
+	for i, m := range w.config.Mixins {
+		if m.Name == name {
+			w.config.Mixins = append(w.config.Mixins[:i], w.config.Mixins[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// path resolves a path stored in the workspace file.
+func (w *workspace) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(w.dir, p)
+}
+
+func (w *workspace) rel(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(w.dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(dir, abs)
+}
+
+func (w *workspace) write() error {
+	content, err := yaml.Marshal(w.config)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.dir, workspaceFile), content, 0644); err != nil {
+		return fmt.Errorf("writing workspace file: %w", err)
+	}
+	return nil
+}
@@ -26,7 +26,8 @@ import (
 
 // InitCommand is basically the same as jb init
 func InitCommand(dir string) error {
-	exists, err := jsonnetfile.Exists(jsonnetfile.File)
+	filename := filepath.Join(dir, jsonnetfile.File)
+	exists, err := jsonnetfile.Exists(filename)
 	if err != nil {
 		return err
 	}
@@ -45,8 +46,6 @@ func InitCommand(dir string) error {
 	}
 	contents = append(contents, []byte("\n")...)
 
-	filename := filepath.Join(dir, jsonnetfile.File)
-
 	err = ioutil.WriteFile(filename, contents, 0644)
 	if err != nil {
 		return fmt.Errorf("Failed to write new jsonnetfile.json, %s", err.Error())
@@ -0,0 +1,36 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonnetbundler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, InitCommand(dir))
+	_, err := os.Stat(filepath.Join(dir, "jsonnetfile.json"))
+	assert.NoError(t, err)
+
+	// The jsonnetfile.json of dir is checked, not the one of the working
+	// directory.
+	assert.Error(t, InitCommand(dir))
+	assert.NoError(t, InitCommand(t.TempDir()))
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonnetbundler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// UninstallCommand is basically the same as jb uninstall: it removes the
+// packages given by uris from jsonnetfile.json and its lock, and removes
+// them and the dependencies no other package needs from the vendor
+// directory.
+func UninstallCommand(dir, jsonnetHome string, uris []string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	jbfilebytes, err := ioutil.ReadFile(filepath.Join(dir, jsonnetfile.File))
+	if err != nil {
+		return fmt.Errorf("failed to load jsonnetfile %s", err.Error())
+	}
+
+	jsonnetFile, err := jsonnetfile.Unmarshal(jbfilebytes)
+	if err != nil {
+		return err
+	}
+
+	jblockfilebytes, err := ioutil.ReadFile(filepath.Join(dir, jsonnetfile.LockFile))
+	if err != nil {
+		return fmt.Errorf("failed to load lockfile %s", err.Error())
+	}
+
+	lockFile, err := jsonnetfile.Unmarshal(jblockfilebytes)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range uris {
+		d := deps.Parse(dir, u)
+		if d == nil {
+			return fmt.Errorf("Unable to parse package URI %s", u)
+		}
+
+		delete(jsonnetFile.Dependencies, d.Name())
+		delete(lockFile.Dependencies, d.Name())
+	}
+
+	// Ensure removes everything from the vendor directory that isn't a
+	// dependency anymore.
+	locked, err := pkg.Ensure(jsonnetFile, filepath.Join(dir, jsonnetHome), lockFile.Dependencies)
+	if err != nil {
+		return fmt.Errorf("failed to uninstall packages %s", err)
+	}
+
+	err = writeChangedJsonnetFile(jbfilebytes, &jsonnetFile, filepath.Join(dir, jsonnetfile.File))
+	if err != nil {
+		return fmt.Errorf("updating jsonnetfile.json %s", err)
+	}
+
+	err = writeChangedJsonnetFile(jblockfilebytes, &v1.JsonnetFile{Dependencies: locked}, filepath.Join(dir, jsonnetfile.LockFile))
+	if err != nil {
+		return fmt.Errorf("updating jsonnetfile.lock.json %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonnetbundler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUninstallCommand(t *testing.T) {
+	// Local packages are resolved against the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NoError(t, InitCommand("."))
+	assert.NoError(t, InstallCommand(".", "vendor", []string{"a", "b"}, false))
+
+	assert.NoError(t, UninstallCommand(".", "vendor", []string{"a"}))
+	for _, file := range []string{jsonnetfile.File, jsonnetfile.LockFile} {
+		f, err := jsonnetfile.Load(file)
+		assert.NoError(t, err)
+		assert.Len(t, f.Dependencies, 1, file)
+		assert.Contains(t, f.Dependencies, "b", file)
+	}
+	_, err = os.Lstat(filepath.Join("vendor", "a"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join("vendor", "b"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonnetbundler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// UpdateCommand is basically the same as jb update: it drops the locked
+// versions of the packages given by uris, or of all packages if none are
+// given, and installs their latest versions.
+func UpdateCommand(dir, jsonnetHome string, uris []string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	jsonnetFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.File))
+	if err != nil {
+		return fmt.Errorf("failed to load jsonnetfile %s", err.Error())
+	}
+
+	lockFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.LockFile))
+	if err != nil {
+		return fmt.Errorf("failed to load lockfile %s", err.Error())
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, jsonnetHome, ".tmp"), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("creating vendor folder %s", err.Error())
+	}
+
+	locks := lockFile.Dependencies
+	for _, u := range uris {
+		d := deps.Parse(dir, u)
+		if d == nil {
+			return fmt.Errorf("Unable to parse package URI %s", u)
+		}
+		delete(locks, d.Name())
+	}
+
+	// no uris: update all
+	if len(uris) == 0 {
+		locks = make(map[string]deps.Dependency)
+	}
+
+	newLocks, err := pkg.Ensure(jsonnetFile, filepath.Join(dir, jsonnetHome), locks)
+	if err != nil {
+		return fmt.Errorf("failed to update packages %s", err)
+	}
+
+	err = writeJSONFile(filepath.Join(dir, jsonnetfile.LockFile), v1.JsonnetFile{Dependencies: newLocks})
+	if err != nil {
+		return fmt.Errorf("updating jsonnetfile.lock.json %s", err)
+	}
+
+	return nil
+}
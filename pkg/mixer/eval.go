@@ -35,7 +35,18 @@ func NewDefaultEvaluator() Evaluator {
 	}
 }
 
+// ExtVars are the external variables available to mixins through
+// std.extVar, given as strings or as jsonnet code.
+type ExtVars struct {
+	Str  map[string]string
+	Code map[string]string
+}
+
 func NewEvaluator(jpath []string) Evaluator {
+	return NewEvaluatorWithExtVars(jpath, ExtVars{})
+}
+
+func NewEvaluatorWithExtVars(jpath []string, extVars ExtVars) Evaluator {
 	vm := jsonnet.MakeVM()
 	vm.Importer(&jsonnet.FileImporter{
 		JPaths: jpath,
@@ -43,6 +54,12 @@ func NewEvaluator(jpath []string) Evaluator {
 	for _, nf := range native.Funcs() {
 		vm.NativeFunction(nf)
 	}
+	for k, v := range extVars.Str {
+		vm.ExtVar(k, v)
+	}
+	for k, v := range extVars.Code {
+		vm.ExtCode(k, v)
+	}
 	return &eval{
 		vm: vm,
 	}
@@ -79,3 +79,56 @@ func TestEvalAlerts(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expectedYaml, string(formatted))
 }
+
+const testConfigJsonnet = `
+{
+	_config+:: {
+		severity: 'warning',
+	},
+	prometheusAlerts+:: {
+		groups+: [
+		  {
+			name: 'test-alerts',
+			rules: [
+			  {
+				alert: 'TestAlert',
+				expr: 'test_alert{cluster="%s"} == 1' % std.extVar('cluster'),
+				labels: {
+				  severity: $._config.severity,
+				},
+			  },
+			],
+		  },
+		],
+	  },
+}
+`
+
+func TestEvalConfigAndExtVars(t *testing.T) {
+	inFile, err := ioutil.TempFile(os.TempDir(), "mixtool-")
+	assert.NoError(t, err)
+	defer os.Remove(inFile.Name())
+
+	_, err = inFile.Write([]byte(testConfigJsonnet))
+	assert.NoError(t, err)
+
+	gen := NewGenerator(&GeneratorOptions{
+		Eval: NewEvaluatorWithExtVars(nil, ExtVars{Str: map[string]string{"cluster": "eu-1"}}),
+	})
+	out, err := gen.Generate(NewAlertsMixin(&RulesAlertsOptions{
+		DataSource: Prometheus,
+		ImportPath: inFile.Name(),
+		Config:     "{ severity: 'critical' }",
+	}))
+	assert.NoError(t, err)
+	formatted, err := JSONtoYaml(out)
+	assert.NoError(t, err)
+	assert.Equal(t, `groups:
+- name: test-alerts
+  rules:
+  - alert: TestAlert
+    expr: test_alert{cluster="eu-1"} == 1
+    labels:
+      severity: critical
+`, string(formatted))
+}
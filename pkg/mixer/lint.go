@@ -20,19 +20,27 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"sort"
+	"strings"
 
 	"github.com/fatih/color"
 	"github.com/grafana/dashboard-linter/lint"
 	"github.com/grafana/loki/pkg/ruler"
+	amconfig "github.com/prometheus/alertmanager/config"
 	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
 	"gopkg.in/yaml.v3"
 )
 
 type LintOptions struct {
-	JPaths     []string
-	Grafana    bool
-	Loki       bool
-	Prometheus bool
+	JPaths         []string
+	Grafana        bool
+	Loki           bool
+	Prometheus     bool
+	RecordingRules bool
+	// RecordingRuleNames checks the names of recording rules against the
+	// level:metric:operations convention.
+	RecordingRuleNames bool
 }
 
 type Linter func(content []byte) []error
@@ -56,6 +64,14 @@ func Lint(w io.Writer, filename string, options LintOptions) error {
 		errCount += printErrs(w, errs)
 	}
 
+	if options.RecordingRuleNames {
+		e := NewEvaluator(options.JPaths)
+		opts := &RulesAlertsOptions{DataSource: Prometheus, ImportPath: filename}
+		errs := make(chan error)
+		go lintRulesAlerts(e, opts, NewRecordingRuleNamesLinter(), errs)
+		errCount += printErrs(w, errs)
+	}
+
 	if options.Grafana {
 		e := NewEvaluator(options.JPaths)
 		opts := &DashboardsOptions{ImportPath: filename}
@@ -64,15 +80,32 @@ func Lint(w io.Writer, filename string, options LintOptions) error {
 		errCount += printErrs(w, errs)
 	}
 
+	// The cross-check needs both the rules and the dashboards of a mixin.
+	if options.RecordingRules && options.Prometheus && options.Grafana {
+		e := NewEvaluator(options.JPaths)
+		errs := make(chan error)
+		go lintRecordingRuleUsage(e, filename, errs)
+		errCount += printErrs(w, errs)
+	}
+
 	if errCount > 0 {
 		return fmt.Errorf("%d lint errors found", errCount)
 	}
 	return nil
 }
 
+// lintWarning is a lint finding that is printed, but doesn't fail the lint.
+type lintWarning struct {
+	error
+}
+
 func printErrs(w io.Writer, errs <-chan error) int {
 	errCount := 0
 	for err := range errs {
+		if _, ok := err.(lintWarning); ok {
+			fmt.Fprintln(w, color.YellowString(err.Error()))
+			continue
+		}
 		fmt.Fprintln(w, color.RedString(err.Error()))
 		errCount++
 	}
@@ -144,6 +177,17 @@ func lintGrafanaDashboards(e Evaluator, opts *DashboardsOptions, errsOut chan<-
 			errsOut <- fmt.Errorf("dashboard has no UID, please set one for links to work: %s", dashboardFilename)
 		}
 
+		queries, err := dashboardQueries(raw)
+		if err != nil {
+			errsOut <- err
+			continue
+		}
+		for _, q := range queries {
+			if err := q.validate(); err != nil {
+				errsOut <- fmt.Errorf("[%s-syntax] '%s' panel '%s' refId '%s': %v", queryLanguage(q.DataSource), q.Dashboard, q.Panel, q.RefID, err)
+			}
+		}
+
 		// Lint using the new grafana/dashboard-linter project.
 		config := lint.NewConfigurationFile()
 		if err := config.Load(path.Dir(opts.ImportPath)); err != nil {
@@ -176,6 +220,111 @@ func lintGrafanaDashboards(e Evaluator, opts *DashboardsOptions, errsOut chan<-
 	}
 }
 
+// lintRecordingRuleUsage cross-checks the recording rules queried by the
+// mixin's dashboards against the ones defined in its Prometheus rules. Rules
+// count as used if a dashboard, an alert or another rule queries them. Unused
+// rules are only warned about, as mixins define rules for users to query, too.
+func lintRecordingRuleUsage(e Evaluator, filename string, errsOut chan<- error) {
+	defer close(errsOut)
+
+	j, err := e.Exec(NewRulesAlertsMixin(&RulesAlertsOptions{DataSource: Prometheus, ImportPath: filename}))
+	if err != nil {
+		errsOut <- err
+		return
+	}
+
+	groups, errs := rulefmt.Parse(j)
+	if len(errs) > 0 {
+		// Invalid rules are reported by the Prometheus linter.
+		return
+	}
+
+	defined := map[string]string{}
+	used := map[string]bool{}
+	for _, g := range groups.Groups {
+		for _, r := range g.Rules {
+			if r.Record.Value != "" {
+				defined[r.Record.Value] = g.Name
+			}
+			expr, err := parser.ParseExpr(r.Expr.Value)
+			if err != nil {
+				continue
+			}
+			for _, name := range metricNames(expr) {
+				used[name] = true
+			}
+		}
+	}
+
+	j, err = e.Exec(NewDashboardsMixin(&DashboardsOptions{ImportPath: filename}))
+	if err != nil {
+		errsOut <- err
+		return
+	}
+
+	var dashboards map[string]json.RawMessage
+	if err := json.Unmarshal(j, &dashboards); err != nil {
+		errsOut <- err
+		return
+	}
+
+	filenames := make([]string, 0, len(dashboards))
+	for dashboardFilename := range dashboards {
+		filenames = append(filenames, dashboardFilename)
+	}
+	sort.Strings(filenames)
+
+	for _, dashboardFilename := range filenames {
+		queries, err := dashboardQueries(dashboards[dashboardFilename])
+		if err != nil {
+			errsOut <- fmt.Errorf("%s: %w", dashboardFilename, err)
+			continue
+		}
+
+		reported := map[string]bool{}
+		for _, q := range queries {
+			if q.DataSource != Prometheus {
+				continue
+			}
+			expr, err := parser.ParseExpr(replaceGrafanaVariables(q.Expr))
+			if err != nil {
+				// Syntax errors are reported by the Grafana linter.
+				continue
+			}
+			for _, name := range metricNames(expr) {
+				used[name] = true
+				if !isRecordingRuleName(name) {
+					continue
+				}
+				if _, ok := defined[name]; ok || reported[q.Panel+" "+name] {
+					continue
+				}
+				reported[q.Panel+" "+name] = true
+				errsOut <- fmt.Errorf("[recording-rule-undefined] '%s' panel '%s': recording rule %s is not defined by the mixin", q.Dashboard, q.Panel, name)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(defined))
+	for name := range defined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !used[name] {
+			errsOut <- lintWarning{fmt.Errorf("[recording-rule-unused] '%s' in group '%s': recording rule is not used by any dashboard, alert or rule", name, defined[name])}
+		}
+	}
+}
+
+func queryLanguage(ds DataSource) string {
+	if ds == Loki {
+		return "logql"
+	}
+	return "promql"
+}
+
 func NewLokiLinter() Linter {
 	return func(content []byte) []error {
 		_, errs := parseLokiAlerts(content)
@@ -183,6 +332,15 @@ func NewLokiLinter() Linter {
 	}
 }
 
+func NewAlertmanagerLinter() Linter {
+	return func(content []byte) []error {
+		if _, err := amconfig.Load(string(content)); err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+}
+
 func NewPrometheusLinter() Linter {
 	return func(content []byte) []error {
 		_, errs := rulefmt.Parse(content)
@@ -190,6 +348,108 @@ func NewPrometheusLinter() Linter {
 	}
 }
 
+// NewRecordingRuleNamesLinter returns a linter checking the names of
+// recording rules. Rules Prometheus fails to load are left to
+// NewPrometheusLinter.
+func NewRecordingRuleNamesLinter() Linter {
+	return func(content []byte) []error {
+		groups, errs := rulefmt.Parse(content)
+		if len(errs) > 0 {
+			return nil
+		}
+		return lintRecordingRuleNames(groups)
+	}
+}
+
+// lintRecordingRuleNames checks that recording rules follow the
+// level:metric:operations naming convention, that the level names the labels
+// the expression aggregates by and that the rules do more than rename a metric.
+func lintRecordingRuleNames(groups *rulefmt.RuleGroups) []error {
+	var errs []error
+	seen := map[string]bool{}
+	report := func(err error) {
+		if !seen[err.Error()] {
+			seen[err.Error()] = true
+			errs = append(errs, err)
+		}
+	}
+	for _, g := range groups.Groups {
+		for _, r := range g.Rules {
+			name := r.Record.Value
+			if name == "" {
+				continue
+			}
+
+			parts := strings.Split(name, ":")
+			if len(parts) < 3 || parts[1] == "" || parts[len(parts)-1] == "" {
+				report(fmt.Errorf("[recording-rule-name] '%s' in group '%s': name does not follow the level:metric:operations format", name, g.Name))
+				continue
+			}
+			level := parts[0]
+
+			// Syntax errors are reported by rulefmt already.
+			expr, err := parser.ParseExpr(r.Expr.Value)
+			if err != nil {
+				continue
+			}
+
+			if vs, ok := unwrapParens(expr).(*parser.VectorSelector); ok {
+				report(fmt.Errorf("[recording-rule-name] '%s' in group '%s': rule only renames %s without any operation", name, g.Name, vs.String()))
+				continue
+			}
+
+			for _, agg := range outerAggregations(expr) {
+				for _, l := range agg.Grouping {
+					switch has := levelHasLabel(level, l); {
+					case !agg.Without && !has:
+						report(fmt.Errorf("[recording-rule-name] '%s' in group '%s': level '%s' does not contain label '%s' the expression aggregates by", name, g.Name, level, l))
+					case agg.Without && has:
+						report(fmt.Errorf("[recording-rule-name] '%s' in group '%s': level '%s' contains label '%s' the expression aggregates away", name, g.Name, level, l))
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		p, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.Expr
+	}
+}
+
+// outerAggregations returns the aggregations that determine the labels of
+// the result of expr, looking through parentheses and binary operations.
+// Of a binary operation, only the sides whose labels the result keeps count.
+func outerAggregations(expr parser.Expr) []*parser.AggregateExpr {
+	switch e := unwrapParens(expr).(type) {
+	case *parser.AggregateExpr:
+		return []*parser.AggregateExpr{e}
+	case *parser.BinaryExpr:
+		switch {
+		case e.Op == parser.LOR:
+			return append(outerAggregations(e.LHS), outerAggregations(e.RHS)...)
+		case e.VectorMatching != nil && e.VectorMatching.Card == parser.CardOneToMany:
+			return outerAggregations(e.RHS)
+		case e.LHS.Type() == parser.ValueTypeScalar:
+			return outerAggregations(e.RHS)
+		}
+		return outerAggregations(e.LHS)
+	}
+	return nil
+}
+
+// levelHasLabel returns whether the level part of a recording rule name,
+// the label names joined by underscores, contains the label.
+func levelHasLabel(level, label string) bool {
+	return strings.Contains("_"+level+"_", "_"+label+"_")
+}
+
 func parseLokiAlerts(content []byte) (*rulefmt.RuleGroups, []error) {
 	var (
 		groups rulefmt.RuleGroups
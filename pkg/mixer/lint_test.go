@@ -17,6 +17,8 @@ package mixer
 import (
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -88,6 +90,186 @@ func TestLintGrafana(t *testing.T) {
 	}
 }
 
+const invalidQueriesMixin = `
+{
+  grafanaDashboards+:: {
+    'test.json': {
+      title: 'Test',
+      uid: 'test',
+      panels: [
+        {
+          title: 'Requests',
+          targets: [
+            { refId: 'A', expr: 'sum(rate(http_requests_total{job="$job"}[$__rate_interval])' },
+            { refId: 'B', expr: 'sum(rate(http_requests_total{job="$job"}[$__rate_interval]))' },
+          ],
+        },
+        {
+          title: 'Logs',
+          datasource: { type: 'loki', uid: '$loki' },
+          targets: [{ refId: 'A', expr: '{job="$job"} |~ ' }],
+        },
+      ],
+    },
+  },
+}
+`
+
+func TestLintGrafanaQueries(t *testing.T) {
+	filename, delete := writeTempFile(t, "mixin.jsonnet", invalidQueriesMixin)
+	defer delete()
+
+	e := NewDefaultEvaluator()
+	opts := &DashboardsOptions{ImportPath: filename}
+	errs := make(chan error)
+	go lintGrafanaDashboards(e, opts, errs)
+
+	var got []string
+	for err := range errs {
+		// Other rules of the dashboard linter are not under test.
+		if strings.Contains(err.Error(), "-syntax] ") {
+			got = append(got, err.Error())
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 lint errors, got %q", got)
+	}
+	for i, prefix := range []string{
+		"[promql-syntax] 'Test' panel 'Requests' refId 'A': ",
+		"[logql-syntax] 'Test' panel 'Logs' refId 'A': ",
+	} {
+		if !strings.HasPrefix(got[i], prefix) {
+			t.Errorf("expected lint error to start with %q, got %q", prefix, got[i])
+		}
+	}
+}
+
+func TestLintRecordingRuleNames(t *testing.T) {
+	const rules = `
+groups:
+  - name: test-rules
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+      - record: instance_mode:node_cpu_seconds:rate5m
+        expr: sum by (instance, mode) (rate(node_cpu_seconds_total[5m]))
+      - record: node:node_memory_utilisation:ratio
+        expr: (node:node_memory_bytes_total:sum - node:node_memory_bytes_available:sum) / scalar(sum(node:node_memory_bytes_total:sum))
+      - record: up_total
+        expr: sum(up)
+      - record: job:up:renamed
+        expr: up{job="node"}
+      - record: job:up:count
+        expr: count by (job, instance) (up)
+      - record: instance:up:max
+        expr: max without (instance) (up)
+      - record: namespace_pod:up:max
+        expr: max by (namespace, pod) (up) * on (namespace, pod) group_left (node) topk by (cluster, namespace, pod) (1, max by (cluster, namespace, pod, node) (kube_pod_info))
+      - record: node:up:sum
+        expr: sum by (node) (up) * on (instance) group_right sum by (instance, node) (node_info)
+      - record: job:up:any
+        expr: count by (job) (up) or sum by (job, instance) (up) or sum by (job, instance) (up)
+`
+	if errs := NewPrometheusLinter()([]byte(rules)); len(errs) > 0 {
+		t.Errorf("expected the rules to load, got %q", errs)
+	}
+
+	errs := NewRecordingRuleNamesLinter()([]byte(rules))
+
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+
+	expected := []string{
+		"[recording-rule-name] 'up_total' in group 'test-rules': name does not follow the level:metric:operations format",
+		`[recording-rule-name] 'job:up:renamed' in group 'test-rules': rule only renames up{job="node"} without any operation`,
+		"[recording-rule-name] 'job:up:count' in group 'test-rules': level 'job' does not contain label 'instance' the expression aggregates by",
+		"[recording-rule-name] 'instance:up:max' in group 'test-rules': level 'instance' contains label 'instance' the expression aggregates away",
+		"[recording-rule-name] 'node:up:sum' in group 'test-rules': level 'node' does not contain label 'instance' the expression aggregates by",
+		"[recording-rule-name] 'job:up:any' in group 'test-rules': level 'job' does not contain label 'instance' the expression aggregates by",
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected lint errors %q, got %q", expected, got)
+	}
+}
+
+const recordingRulesMixin = `
+{
+  prometheusRules+:: {
+    groups+: [
+      {
+        name: 'test-rules',
+        rules: [
+          { record: 'job:up:sum', expr: 'sum by (job) (up)' },
+          { record: 'job:up:avg', expr: 'avg by (job) (up)' },
+          { record: 'instance:up:max', expr: 'max by (instance) (up)' },
+        ],
+      },
+    ],
+  },
+  prometheusAlerts+:: {
+    groups+: [
+      {
+        name: 'test-alerts',
+        rules: [
+          { alert: 'JobDown', expr: 'job:up:avg == 0' },
+        ],
+      },
+    ],
+  },
+  grafanaDashboards+:: {
+    'test.json': {
+      title: 'Test',
+      panels: [
+        {
+          title: 'Up',
+          targets: [
+            { refId: 'A', expr: 'job:up:sum{job=~"$job"}' },
+            { refId: 'B', expr: 'sum(rate(node_cpu_seconds_total{cluster="$cluster"}[$__rate_interval]))' },
+          ],
+        },
+        {
+          title: 'Row',
+          type: 'row',
+          panels: [
+            { title: 'Missing', targets: [{ refId: 'A', expr: 'cluster:node_cpu:ratio' }] },
+          ],
+        },
+      ],
+    },
+  },
+}
+`
+
+func TestLintRecordingRuleUsage(t *testing.T) {
+	filename, delete := writeTempFile(t, "mixin.jsonnet", recordingRulesMixin)
+	defer delete()
+
+	e := NewDefaultEvaluator()
+	errs := make(chan error)
+	go lintRecordingRuleUsage(e, filename, errs)
+
+	var got []string
+	for err := range errs {
+		got = append(got, err.Error())
+		// Only unused rules are warnings.
+		_, warning := err.(lintWarning)
+		if unused := strings.HasPrefix(err.Error(), "[recording-rule-unused]"); warning != unused {
+			t.Errorf("expected %q to be a warning: %t", err, unused)
+		}
+	}
+
+	expected := []string{
+		"[recording-rule-undefined] 'Test' panel 'Missing': recording rule cluster:node_cpu:ratio is not defined by the mixin",
+		"[recording-rule-unused] 'instance:up:max' in group 'test-rules': recording rule is not used by any dashboard, alert or rule",
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected lint errors %q, got %q", expected, got)
+	}
+}
+
 func writeTempFile(t *testing.T, pattern string, contents string) (filename string, delete func()) {
 	f, err := ioutil.TempFile("", pattern)
 	if err != nil {
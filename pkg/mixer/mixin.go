@@ -5,6 +5,10 @@ import "fmt"
 const (
 	importFormat = `
 local mixin = (import %q);
+`
+
+	importConfigFormat = `
+local mixin = (import %q) + { _config+:: %s };
 `
 
 	alertsFormat = `
@@ -45,6 +49,8 @@ const (
 type RulesAlertsOptions struct {
 	DataSource DataSource
 	ImportPath string
+	// Config is a jsonnet object merged into the _config of the mixin, if set.
+	Config string
 }
 
 type Mixin []byte
@@ -52,23 +58,32 @@ type Mixin []byte
 type MixinBuilder func(opts *RulesAlertsOptions) Mixin
 
 func NewAlertsMixin(opts *RulesAlertsOptions) Mixin {
-	return Mixin(fmt.Sprintf(importFormat, opts.ImportPath) + fmt.Sprintf(alertsFormat, opts.DataSource))
+	return Mixin(importMixin(opts.ImportPath, opts.Config) + fmt.Sprintf(alertsFormat, opts.DataSource))
 }
 
 func NewRulesMixin(opts *RulesAlertsOptions) Mixin {
-	return Mixin(fmt.Sprintf(importFormat, opts.ImportPath) + fmt.Sprintf(rulesFormat, opts.DataSource))
+	return Mixin(importMixin(opts.ImportPath, opts.Config) + fmt.Sprintf(rulesFormat, opts.DataSource))
 }
 
 func NewRulesAlertsMixin(opts *RulesAlertsOptions) Mixin {
-	return Mixin(fmt.Sprintf(importFormat, opts.ImportPath) + fmt.Sprintf(rulesAlertsFormat, opts.DataSource))
+	return Mixin(importMixin(opts.ImportPath, opts.Config) + fmt.Sprintf(rulesAlertsFormat, opts.DataSource))
 }
 
 type DashboardsOptions struct {
 	ImportPath string
+	// Config is a jsonnet object merged into the _config of the mixin, if set.
+	Config string
+}
+
+func importMixin(importPath, config string) string {
+	if config == "" {
+		return fmt.Sprintf(importFormat, importPath)
+	}
+	return fmt.Sprintf(importConfigFormat, importPath, config)
 }
 
 func NewDashboardsMixin(opts *DashboardsOptions) Mixin {
-	return Mixin(fmt.Sprintf(importFormat, opts.ImportPath) + dashboards)
+	return Mixin(importMixin(opts.ImportPath, opts.Config) + dashboards)
 }
 
 func (m Mixin) ApplyFormatter(f Formatter) (Mixin, error) {
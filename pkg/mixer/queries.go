@@ -0,0 +1,258 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixer
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// dashboardQuery is a query of a single panel target in a Grafana dashboard.
+type dashboardQuery struct {
+	Dashboard  string
+	Panel      string
+	RefID      string
+	Expr       string
+	DataSource DataSource
+}
+
+type dashboardJSON struct {
+	Title  string      `json:"title"`
+	Panels []panelJSON `json:"panels"`
+	// Rows are only set on dashboards older than schema version 16.
+	Rows []struct {
+		Panels []panelJSON `json:"panels"`
+	} `json:"rows"`
+	Templating struct {
+		List []struct {
+			Name  string          `json:"name"`
+			Type  string          `json:"type"`
+			Query json.RawMessage `json:"query"`
+		} `json:"list"`
+	} `json:"templating"`
+}
+
+type panelJSON struct {
+	Title      string          `json:"title"`
+	Datasource json.RawMessage `json:"datasource"`
+	Targets    []targetJSON    `json:"targets"`
+	// Panels are set on collapsed rows.
+	Panels []panelJSON `json:"panels"`
+}
+
+type targetJSON struct {
+	Expr       string          `json:"expr"`
+	RefID      string          `json:"refId"`
+	Datasource json.RawMessage `json:"datasource"`
+}
+
+// dashboardQueries returns the queries of all panel targets in the dashboard
+// that have an expression.
+func dashboardQueries(raw []byte) ([]dashboardQuery, error) {
+	var db dashboardJSON
+	if err := json.Unmarshal(raw, &db); err != nil {
+		return nil, err
+	}
+
+	panels := db.Panels
+	for _, row := range db.Rows {
+		panels = append(panels, row.Panels...)
+	}
+
+	var queries []dashboardQuery
+	var walk func(panels []panelJSON)
+	walk = func(panels []panelJSON) {
+		for _, p := range panels {
+			for _, t := range p.Targets {
+				if strings.TrimSpace(t.Expr) == "" {
+					continue
+				}
+				ds := t.Datasource
+				if isNullJSON(ds) {
+					ds = p.Datasource
+				}
+				queries = append(queries, dashboardQuery{
+					Dashboard:  db.Title,
+					Panel:      p.Title,
+					RefID:      t.RefID,
+					Expr:       t.Expr,
+					DataSource: db.dataSource(ds),
+				})
+			}
+			walk(p.Panels)
+		}
+	}
+	walk(panels)
+
+	return queries, nil
+}
+
+// dataSource returns the kind of data source referenced by a panel or target,
+// resolving datasource template variables. References without a kind, like
+// plain data source names, are assumed to be Prometheus, the default of most
+// mixins. Data sources other than Prometheus and Loki result in "".
+func (db *dashboardJSON) dataSource(raw json.RawMessage) DataSource {
+	if isNullJSON(raw) {
+		return Prometheus
+	}
+
+	var name string
+	if err := json.Unmarshal(raw, &name); err != nil {
+		var ref struct {
+			Type string `json:"type"`
+			UID  string `json:"uid"`
+		}
+		if err := json.Unmarshal(raw, &ref); err != nil {
+			return Prometheus
+		}
+		if ref.Type != "" {
+			return dataSourceOfType(ref.Type)
+		}
+		name = ref.UID
+	}
+
+	if m := grafanaVariable.FindStringSubmatch(name); m != nil && m[0] == name {
+		for _, v := range db.Templating.List {
+			if v.Type != "datasource" || (v.Name != m[1] && v.Name != m[2] && v.Name != m[3]) {
+				continue
+			}
+			var query string
+			if err := json.Unmarshal(v.Query, &query); err == nil {
+				return dataSourceOfType(query)
+			}
+		}
+		return Prometheus
+	}
+
+	switch lower := strings.ToLower(name); {
+	case strings.Contains(lower, "loki"):
+		return Loki
+	case strings.HasPrefix(lower, "-- "):
+		// Built-in data sources like -- Grafana -- and -- Mixed --.
+		return ""
+	}
+	return Prometheus
+}
+
+func dataSourceOfType(t string) DataSource {
+	switch DataSource(t) {
+	case Loki, Prometheus:
+		return DataSource(t)
+	}
+	return ""
+}
+
+func isNullJSON(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// validate parses the query with the parser of its data source, after
+// replacing Grafana template variables.
+func (q dashboardQuery) validate() error {
+	expr := replaceGrafanaVariables(q.Expr)
+	switch q.DataSource {
+	case Prometheus:
+		_, err := parser.ParseExpr(expr)
+		return err
+	case Loki:
+		_, err := logql.ParseExpr(expr)
+		return err
+	}
+	return nil
+}
+
+// grafanaVariable matches the $var, ${var}, ${var:format} and [[var]] syntaxes
+// of Grafana template variables.
+var grafanaVariable = regexp.MustCompile(`\$(\w+)|\$\{(\w+)(?::[^}]*)?\}|\[\[(\w+)(?::[^\]]*)?\]\]`)
+
+// replaceGrafanaVariables replaces Grafana template variables in a query with
+// placeholders, so that the query can be parsed. Variables used as durations,
+// like $__rate_interval in a range selector, are replaced with a duration,
+// all others with an identifier that is valid as label value and metric name.
+func replaceGrafanaVariables(expr string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range grafanaVariable.FindAllStringSubmatchIndex(expr, -1) {
+		b.WriteString(expr[last:m[0]])
+		last = m[1]
+
+		name := ""
+		for i := 2; i < len(m); i += 2 {
+			if m[i] >= 0 {
+				name = expr[m[i]:m[i+1]]
+				break
+			}
+		}
+
+		if isDurationVariable(name) || inDurationPosition(expr[:m[0]]) {
+			b.WriteString("5m")
+		} else {
+			b.WriteString("var")
+		}
+	}
+	b.WriteString(expr[last:])
+	return b.String()
+}
+
+func isDurationVariable(name string) bool {
+	switch name {
+	case "__interval", "__rate_interval", "__range":
+		return true
+	}
+	return strings.HasPrefix(name, "__auto_interval")
+}
+
+// inDurationPosition returns whether a variable following prefix is used as a
+// duration: within a range or subquery selector, or after an offset modifier.
+func inDurationPosition(prefix string) bool {
+	prefix = strings.TrimRight(prefix, " \t\n")
+	if strings.HasSuffix(prefix, "[") || strings.HasSuffix(prefix, ":") {
+		return strings.LastIndex(prefix, "[") > strings.LastIndex(prefix, "]")
+	}
+	return strings.HasSuffix(prefix, "offset")
+}
+
+// metricNames returns the names of all metrics selected in expr.
+func metricNames(expr parser.Expr) []string {
+	var names []string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		if vs.Name != "" {
+			names = append(names, vs.Name)
+			return nil
+		}
+		for _, m := range vs.LabelMatchers {
+			if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+				names = append(names, m.Value)
+			}
+		}
+		return nil
+	})
+	return names
+}
+
+// isRecordingRuleName returns whether name follows the level:metric:operations
+// naming of recording rules. Colons are reserved for them in metric names.
+func isRecordingRuleName(name string) bool {
+	return strings.Contains(name, ":")
+}
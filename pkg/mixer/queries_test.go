@@ -0,0 +1,131 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixer
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceGrafanaVariables(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{
+			expr:     `up{job="$job"}`,
+			expected: `up{job="var"}`,
+		},
+		{
+			expr:     `rate(x{cluster=~"${cluster:regex}"}[$__rate_interval])`,
+			expected: `rate(x{cluster=~"var"}[5m])`,
+		},
+		{
+			expr:     `sum by ([[groupBy]]) (rate(x[$interval]))`,
+			expected: `sum by (var) (rate(x[5m]))`,
+		},
+		{
+			expr:     `max_over_time(rate(x[1m])[$range:$step] offset $offset)`,
+			expected: `max_over_time(rate(x[1m])[5m:5m] offset 5m)`,
+		},
+		{
+			expr:     `x > $threshold`,
+			expected: `x > var`,
+		},
+	}
+
+	for _, test := range tests {
+		got := replaceGrafanaVariables(test.expr)
+		assert.Equal(t, test.expected, got)
+		_, err := parser.ParseExpr(got)
+		assert.NoError(t, err, got)
+	}
+}
+
+func TestDashboardQueries(t *testing.T) {
+	const dashboard = `{
+  "title": "Test",
+  "panels": [
+    {"title": "A", "targets": [{"refId": "A", "expr": "up"}, {"refId": "B", "expr": ""}]},
+    {"title": "Row", "type": "row", "panels": [{"title": "B", "targets": [{"refId": "A", "expr": "down"}]}]}
+  ],
+  "rows": [
+    {"panels": [{"title": "C", "targets": [{"refId": "A", "expr": "sideways"}]}]}
+  ]
+}`
+
+	queries, err := dashboardQueries([]byte(dashboard))
+	assert.NoError(t, err)
+	assert.Equal(t, []dashboardQuery{
+		{Dashboard: "Test", Panel: "A", RefID: "A", Expr: "up", DataSource: Prometheus},
+		{Dashboard: "Test", Panel: "B", RefID: "A", Expr: "down", DataSource: Prometheus},
+		{Dashboard: "Test", Panel: "C", RefID: "A", Expr: "sideways", DataSource: Prometheus},
+	}, queries)
+}
+
+func TestDashboardQueriesDataSource(t *testing.T) {
+	const dashboard = `{
+  "title": "Test",
+  "templating": {"list": [
+    {"name": "datasource", "type": "datasource", "query": "prometheus"},
+    {"name": "loki", "type": "datasource", "query": "loki"}
+  ]},
+  "panels": [
+    {"title": "Variable", "datasource": "$datasource", "targets": [{"refId": "A", "expr": "up"}]},
+    {"title": "Loki variable", "datasource": "${loki}", "targets": [{"refId": "A", "expr": "{job=\"app\"}"}]},
+    {"title": "Reference", "datasource": {"type": "loki", "uid": "abc"}, "targets": [{"refId": "A", "expr": "{job=\"app\"}"}]},
+    {"title": "Name", "datasource": "Loki", "targets": [{"refId": "A", "expr": "{job=\"app\"}"}]},
+    {"title": "Mixed", "datasource": "-- Mixed --", "targets": [
+      {"refId": "A", "expr": "up", "datasource": {"type": "prometheus", "uid": "${datasource}"}},
+      {"refId": "B", "expr": "{job=\"app\"}", "datasource": {"uid": "$loki"}},
+      {"refId": "C", "expr": "x"}
+    ]},
+    {"title": "Other", "datasource": {"type": "elasticsearch"}, "targets": [{"refId": "A", "expr": "*"}]}
+  ]
+}`
+
+	queries, err := dashboardQueries([]byte(dashboard))
+	assert.NoError(t, err)
+
+	var got []DataSource
+	for _, q := range queries {
+		got = append(got, q.DataSource)
+	}
+	assert.Equal(t, []DataSource{Prometheus, Loki, Loki, Loki, Prometheus, Loki, "", ""}, got)
+}
+
+func TestDashboardQueryValidate(t *testing.T) {
+	tests := []struct {
+		query dashboardQuery
+		valid bool
+	}{
+		{query: dashboardQuery{Expr: `rate(up{job="$job"}[$__rate_interval])`, DataSource: Prometheus}, valid: true},
+		{query: dashboardQuery{Expr: `sum(rate(up[5m])`, DataSource: Prometheus}},
+		{query: dashboardQuery{Expr: `sum(count_over_time({job="$job"} |= "error" [$__interval]))`, DataSource: Loki}, valid: true},
+		{query: dashboardQuery{Expr: `{job="app"} |= `, DataSource: Loki}},
+		{query: dashboardQuery{Expr: `not a query`}, valid: true},
+	}
+
+	for _, test := range tests {
+		err := test.query.validate()
+		if test.valid {
+			assert.NoError(t, err, test.query.Expr)
+		} else {
+			assert.Error(t, err, test.query.Expr)
+		}
+	}
+}
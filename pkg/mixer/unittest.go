@@ -0,0 +1,679 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/go-kit/log"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/grafana/loki/pkg/ruler"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/util/teststorage"
+	"github.com/weaveworks/common/user"
+	"gopkg.in/yaml.v3"
+)
+
+type TestOptions struct {
+	JPaths     []string
+	DataSource DataSource
+}
+
+// Test evaluates the rules and alerts of the mixin in filename for the data
+// source in options and runs the unit test files against them. Prometheus
+// test files follow the promtool format, Loki test files take log streams as
+// input and test LogQL expressions instead. The mixin's rules are kept in
+// memory; rule_files given in a test file are loaded in addition.
+func Test(w io.Writer, filename string, testFiles []string, options TestOptions) error {
+	if options.DataSource == "" {
+		options.DataSource = Prometheus
+	}
+
+	e := NewEvaluator(options.JPaths)
+	j, err := e.Exec(NewRulesAlertsMixin(&RulesAlertsOptions{DataSource: options.DataSource, ImportPath: filename}))
+	if err != nil {
+		return err
+	}
+
+	var (
+		groups *rulefmt.RuleGroups
+		errs   []error
+		test   func(filename string, loader *mixinGroupLoader) []error
+		loader = &mixinGroupLoader{name: filename}
+	)
+	switch options.DataSource {
+	case Prometheus:
+		groups, errs = rulefmt.Parse(j)
+		loader.fallback = rules.FileLoader{}
+		test = ruleUnitTest
+	case Loki:
+		groups, errs = parseLokiAlerts(j)
+		loader.fallback = ruler.GroupLoader{}
+		test = lokiRuleUnitTest
+	default:
+		return fmt.Errorf("unknown data source %q", options.DataSource)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to parse rules of %s: %v", filename, errs)
+	}
+	loader.groups = groups
+
+	failed := 0
+	for _, tf := range testFiles {
+		fmt.Fprintf(w, "Unit Testing: %s\n", tf)
+		errs := test(tf, loader)
+		if len(errs) == 0 {
+			fmt.Fprintln(w, color.GreenString("  SUCCESS"))
+			continue
+		}
+
+		fmt.Fprintln(w, color.RedString("  FAILED:"))
+		for _, err := range errs {
+			fmt.Fprintln(w, color.RedString(err.Error()))
+		}
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d test files failed", failed, len(testFiles))
+	}
+	return nil
+}
+
+// mixinGroupLoader serves the rule groups generated from a mixin under its
+// filename and hands any other identifier to the fallback loader.
+type mixinGroupLoader struct {
+	name     string
+	groups   *rulefmt.RuleGroups
+	fallback rules.GroupLoader
+}
+
+func (l *mixinGroupLoader) Load(identifier string) (*rulefmt.RuleGroups, []error) {
+	if identifier == l.name {
+		return l.groups, nil
+	}
+	return l.fallback.Load(identifier)
+}
+
+func (l *mixinGroupLoader) Parse(query string) (parser.Expr, error) {
+	return l.fallback.Parse(query)
+}
+
+// unitTestConfig holds the settings shared by Prometheus and Loki test files.
+type unitTestConfig struct {
+	RuleFiles          []string       `yaml:"rule_files"`
+	EvaluationInterval model.Duration `yaml:"evaluation_interval,omitempty"`
+	GroupEvalOrder     []string       `yaml:"group_eval_order"`
+}
+
+// unitTestFile holds the contents of a single promtool-style unit test file.
+type unitTestFile struct {
+	unitTestConfig `yaml:",inline"`
+	Tests          []testGroup `yaml:"tests"`
+}
+
+// lokiUnitTestFile holds the contents of a single Loki unit test file.
+type lokiUnitTestFile struct {
+	unitTestConfig `yaml:",inline"`
+	Tests          []lokiTestGroup `yaml:"tests"`
+}
+
+// testGroupConfig holds the settings shared by Prometheus and Loki test groups.
+type testGroupConfig struct {
+	Interval       model.Duration  `yaml:"interval"`
+	AlertRuleTests []alertTestCase `yaml:"alert_rule_test,omitempty"`
+	ExternalLabels labels.Labels   `yaml:"external_labels,omitempty"`
+	ExternalURL    string          `yaml:"external_url,omitempty"`
+	TestGroupName  string          `yaml:"name,omitempty"`
+}
+
+// testGroup is a group of input series and the tests run against them.
+type testGroup struct {
+	testGroupConfig `yaml:",inline"`
+	InputSeries     []series       `yaml:"input_series"`
+	PromqlExprTests []exprTestCase `yaml:"promql_expr_test,omitempty"`
+}
+
+// lokiTestGroup is a group of input log streams and the tests run against them.
+type lokiTestGroup struct {
+	testGroupConfig `yaml:",inline"`
+	InputStreams    []stream       `yaml:"input_streams"`
+	LogqlExprTests  []exprTestCase `yaml:"logql_expr_test,omitempty"`
+}
+
+type series struct {
+	Series string `yaml:"series"`
+	Values string `yaml:"values"`
+}
+
+type stream struct {
+	Stream  string        `yaml:"stream"`
+	Entries []streamEntry `yaml:"entries"`
+}
+
+// streamEntry is a log line at ts. It is repeated the given number of times,
+// each repetition one test group interval after the previous one.
+type streamEntry struct {
+	TS     model.Duration `yaml:"ts"`
+	Line   string         `yaml:"line"`
+	Repeat int            `yaml:"repeat,omitempty"`
+}
+
+type alertTestCase struct {
+	EvalTime  model.Duration `yaml:"eval_time"`
+	Alertname string         `yaml:"alertname"`
+	ExpAlerts []expAlert     `yaml:"exp_alerts"`
+}
+
+type expAlert struct {
+	ExpLabels      map[string]string `yaml:"exp_labels"`
+	ExpAnnotations map[string]string `yaml:"exp_annotations"`
+}
+
+type exprTestCase struct {
+	Expr       string         `yaml:"expr"`
+	EvalTime   model.Duration `yaml:"eval_time"`
+	ExpSamples []expSample    `yaml:"exp_samples"`
+}
+
+type expSample struct {
+	Labels string  `yaml:"labels"`
+	Value  float64 `yaml:"value"`
+}
+
+// testRun holds what all test groups of a test file are run with.
+type testRun struct {
+	ruleFiles    []string
+	evalInterval time.Duration
+	groupOrder   map[string]int
+	loader       *mixinGroupLoader
+}
+
+func ruleUnitTest(filename string, loader *mixinGroupLoader) []error {
+	var utf unitTestFile
+	if err := parseUnitTestFile(filename, &utf); err != nil {
+		return []error{err}
+	}
+
+	run, err := utf.newTestRun(filename, loader)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, tg := range utf.Tests {
+		errs = append(errs, tg.test(run)...)
+	}
+	return errs
+}
+
+func lokiRuleUnitTest(filename string, loader *mixinGroupLoader) []error {
+	var utf lokiUnitTestFile
+	if err := parseUnitTestFile(filename, &utf); err != nil {
+		return []error{err}
+	}
+
+	run, err := utf.newTestRun(filename, loader)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, tg := range utf.Tests {
+		errs = append(errs, tg.test(run)...)
+	}
+	return errs
+}
+
+func parseUnitTestFile(filename string, out interface{}) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	return nil
+}
+
+func (c *unitTestConfig) newTestRun(filename string, loader *mixinGroupLoader) (*testRun, error) {
+	// The mixin's own rules are always under test, rule_files only add to them.
+	ruleFiles := []string{loader.name}
+	for _, rf := range c.RuleFiles {
+		if !filepath.IsAbs(rf) {
+			rf = filepath.Join(filepath.Dir(filename), rf)
+		}
+		matches, err := filepath.Glob(rf)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no rule file matches pattern %s", rf)
+		}
+		ruleFiles = append(ruleFiles, matches...)
+	}
+
+	evalInterval := time.Duration(c.EvaluationInterval)
+	if evalInterval == 0 {
+		evalInterval = time.Minute
+	}
+
+	groupOrder := make(map[string]int, len(c.GroupEvalOrder))
+	for i, name := range c.GroupEvalOrder {
+		if _, ok := groupOrder[name]; ok {
+			return nil, fmt.Errorf("group name repeated in evaluation order: %s", name)
+		}
+		groupOrder[name] = i
+	}
+
+	return &testRun{
+		ruleFiles:    ruleFiles,
+		evalInterval: evalInterval,
+		groupOrder:   groupOrder,
+		loader:       loader,
+	}, nil
+}
+
+func (tg *testGroup) test(run *testRun) []error {
+	if tg.Interval == 0 {
+		tg.Interval = model.Duration(run.evalInterval)
+	}
+
+	suite, err := promql.NewLazyLoader(nil, tg.seriesLoadingString(), promql.LazyLoaderOpts{
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+	if err != nil {
+		return []error{err}
+	}
+	defer suite.Close()
+	suite.SubqueryInterval = run.evalInterval
+
+	opts := &rules.ManagerOptions{
+		QueryFunc:  rules.EngineQueryFunc(suite.QueryEngine(), suite.Storage()),
+		Appendable: suite.Storage(),
+		Context:    suite.Context(),
+	}
+	return run.run(&tg.testGroupConfig, tg.PromqlExprTests, opts, func(ts time.Time) error {
+		var err error
+		suite.WithSamplesTill(ts, func(e error) { err = e })
+		return err
+	})
+}
+
+// seriesLoadingString returns the input series in PromQL test notation.
+func (tg *testGroup) seriesLoadingString() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "load %v\n", shortDuration(tg.Interval))
+	for _, s := range tg.InputSeries {
+		fmt.Fprintf(&b, "  %v %v\n", s.Series, s.Values)
+	}
+	return b.String()
+}
+
+func (tg *lokiTestGroup) test(run *testRun) []error {
+	if tg.Interval == 0 {
+		tg.Interval = model.Duration(run.evalInterval)
+	}
+
+	streams, err := tg.streams()
+	if err != nil {
+		return []error{err}
+	}
+
+	// Recording rules and the ALERTS series are written to a throwaway
+	// Prometheus storage, as a Loki ruler would remote-write them.
+	storage := teststorage.New(nil)
+	defer storage.Close()
+
+	engine := logql.NewEngine(logql.EngineOpts{}, logql.NewMockQuerier(0, streams), logql.NoLimits, log.NewNopLogger())
+	opts := &rules.ManagerOptions{
+		QueryFunc:  lokiQueryFunc(engine),
+		Appendable: storage,
+		Context:    user.InjectOrgID(context.Background(), "mixtool"),
+	}
+	// All log lines are known upfront, LogQL only sees those within the queried range.
+	return run.run(&tg.testGroupConfig, tg.LogqlExprTests, opts, func(time.Time) error { return nil })
+}
+
+// streams returns the input streams with their entries sorted by time.
+func (tg *lokiTestGroup) streams() ([]logproto.Stream, error) {
+	mint := time.Unix(0, 0).UTC()
+
+	streams := make([]logproto.Stream, 0, len(tg.InputStreams))
+	for _, s := range tg.InputStreams {
+		lbls, err := parser.ParseMetric(s.Stream)
+		if err != nil {
+			return nil, fmt.Errorf("stream %q: %w", s.Stream, err)
+		}
+
+		st := logproto.Stream{Labels: lbls.String(), Hash: lbls.Hash()}
+		for _, e := range s.Entries {
+			for i := 0; i <= e.Repeat; i++ {
+				st.Entries = append(st.Entries, logproto.Entry{
+					Timestamp: mint.Add(time.Duration(e.TS) + time.Duration(i)*time.Duration(tg.Interval)),
+					Line:      e.Line,
+				})
+			}
+		}
+		sort.SliceStable(st.Entries, func(i, j int) bool {
+			return st.Entries[i].Timestamp.Before(st.Entries[j].Timestamp)
+		})
+		streams = append(streams, st)
+	}
+	return streams, nil
+}
+
+// lokiQueryFunc evaluates LogQL instant queries the same way the Loki ruler does.
+func lokiQueryFunc(engine *logql.Engine) rules.QueryFunc {
+	return func(ctx context.Context, qs string, t time.Time) (promql.Vector, error) {
+		params := logql.NewLiteralParams(qs, t, t, 0, 0, logproto.FORWARD, 0, nil)
+		res, err := engine.Query(params).Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := res.Data.(type) {
+		case promql.Vector:
+			return v, nil
+		case promql.Scalar:
+			return promql.Vector{promql.Sample{Point: promql.Point(v), Metric: labels.Labels{}}}, nil
+		default:
+			return nil, fmt.Errorf("rule result is not a vector or scalar")
+		}
+	}
+}
+
+// run loads the rule groups and evaluates them every evaluation interval up
+// to the latest eval_time of the test group, checking the alert tests due at
+// each step and the expression tests at the end. load is called before each
+// evaluation to make the input up to ts queryable.
+func (run *testRun) run(tg *testGroupConfig, exprTests []exprTestCase, opts *rules.ManagerOptions, load func(ts time.Time) error) []error {
+	opts.NotifyFunc = func(ctx context.Context, expr string, alerts ...*rules.Alert) {}
+	opts.Logger = log.NewNopLogger()
+	opts.GroupLoader = run.loader
+
+	m := rules.NewManager(opts)
+	groupsMap, errs := m.LoadGroups(time.Duration(tg.Interval), tg.ExternalLabels, tg.ExternalURL, run.ruleFiles...)
+	if errs != nil {
+		return errs
+	}
+	groups := orderedGroups(groupsMap, run.groupOrder)
+
+	for _, g := range groups {
+		for _, r := range g.Rules() {
+			// Restored alerting rules create the ALERTS series when they run.
+			if ar, ok := r.(*rules.AlertingRule); ok {
+				ar.SetRestored(true)
+			}
+		}
+	}
+
+	alertTests := make(map[model.Duration][]alertTestCase)
+	for _, at := range tg.AlertRuleTests {
+		if at.Alertname == "" {
+			return []error{fmt.Errorf("%salert_rule_test at eval_time %s misses required attribute alertname", tg.prefix(), at.EvalTime)}
+		}
+		alertTests[at.EvalTime] = append(alertTests[at.EvalTime], at)
+	}
+	alertEvalTimes := make([]model.Duration, 0, len(alertTests))
+	for t := range alertTests {
+		alertEvalTimes = append(alertEvalTimes, t)
+	}
+	sort.Slice(alertEvalTimes, func(i, j int) bool { return alertEvalTimes[i] < alertEvalTimes[j] })
+
+	mint := time.Unix(0, 0).UTC()
+	maxt := mint.Add(maxEvalTime(tg.AlertRuleTests, exprTests))
+	curr := 0
+
+	for ts := mint; !ts.After(maxt); ts = ts.Add(run.evalInterval) {
+		if err := load(ts); err != nil {
+			return append(errs, err)
+		}
+
+		var evalErrs []error
+		for _, g := range groups {
+			g.Eval(opts.Context, ts)
+			for _, r := range g.Rules() {
+				if r.LastError() != nil {
+					evalErrs = append(evalErrs, fmt.Errorf("    rule: %s, time: %s, err: %v", r.Name(), ts.Sub(mint), r.LastError()))
+				}
+			}
+		}
+		if len(evalErrs) > 0 {
+			return append(errs, evalErrs...)
+		}
+
+		// Alerts expected at eval_time t are compared to the evaluation
+		// at ts, where ts <= t < ts+evalInterval.
+		for curr < len(alertEvalTimes) && time.Duration(alertEvalTimes[curr]) < ts.Add(run.evalInterval).Sub(mint) {
+			t := alertEvalTimes[curr]
+			for _, at := range alertTests[t] {
+				if err := tg.checkAlerts(at, firingAlerts(groups, at.Alertname)); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			curr++
+		}
+	}
+
+	for _, et := range exprTests {
+		if err := et.check(opts.Context, opts.QueryFunc, mint); err != nil {
+			errs = append(errs, fmt.Errorf("%s%w", tg.prefix(), err))
+		}
+	}
+
+	return errs
+}
+
+// maxEvalTime returns the latest eval_time of all alert and expression tests.
+func maxEvalTime(alertTests []alertTestCase, exprTests []exprTestCase) time.Duration {
+	var maxd model.Duration
+	for _, at := range alertTests {
+		if at.EvalTime > maxd {
+			maxd = at.EvalTime
+		}
+	}
+	for _, et := range exprTests {
+		if et.EvalTime > maxd {
+			maxd = et.EvalTime
+		}
+	}
+	return time.Duration(maxd)
+}
+
+func (tg *testGroupConfig) prefix() string {
+	if tg.TestGroupName == "" {
+		return ""
+	}
+	return fmt.Sprintf("    name: %s,\n", tg.TestGroupName)
+}
+
+func (tg *testGroupConfig) checkAlerts(at alertTestCase, got labelsAndAnnotations) error {
+	var exp labelsAndAnnotations
+	for _, a := range at.ExpAlerts {
+		// The alertname label is added by Prometheus during evaluation.
+		lbls := map[string]string{labels.AlertName: at.Alertname}
+		for k, v := range a.ExpLabels {
+			lbls[k] = v
+		}
+		exp = append(exp, labelAndAnnotation{
+			Labels:      labels.FromMap(lbls),
+			Annotations: labels.FromMap(a.ExpAnnotations),
+		})
+	}
+
+	sort.Sort(got)
+	sort.Sort(exp)
+
+	if reflect.DeepEqual(exp, got) {
+		return nil
+	}
+	return fmt.Errorf("%s    alertname: %s, time: %s,\n        exp: %v,\n        got: %v",
+		tg.prefix(), at.Alertname, at.EvalTime, exp, got)
+}
+
+func (et exprTestCase) check(ctx context.Context, query rules.QueryFunc, mint time.Time) error {
+	vec, err := query(ctx, et.Expr, mint.Add(time.Duration(et.EvalTime)))
+	if err != nil {
+		return fmt.Errorf("    expr: %q, time: %s, err: %v", et.Expr, et.EvalTime, err)
+	}
+
+	var got samples
+	for _, s := range vec {
+		got = append(got, parsedSample{Labels: s.Metric.Copy(), Value: s.V})
+	}
+
+	var exp samples
+	for _, s := range et.ExpSamples {
+		lbls, err := parser.ParseMetric(s.Labels)
+		if err != nil {
+			return fmt.Errorf("    expr: %q, time: %s, err: labels %q: %v", et.Expr, et.EvalTime, s.Labels, err)
+		}
+		exp = append(exp, parsedSample{Labels: lbls, Value: s.Value})
+	}
+
+	sort.Sort(got)
+	sort.Sort(exp)
+
+	if reflect.DeepEqual(exp, got) {
+		return nil
+	}
+	return fmt.Errorf("    expr: %q, time: %s,\n        exp: %v\n        got: %v", et.Expr, et.EvalTime, exp, got)
+}
+
+// firingAlerts collects the firing alerts with the given name. The same alert
+// name can be present in multiple groups, so all of them are considered.
+func firingAlerts(groups []*rules.Group, name string) labelsAndAnnotations {
+	var got labelsAndAnnotations
+	for _, g := range groups {
+		for _, r := range g.Rules() {
+			ar, ok := r.(*rules.AlertingRule)
+			if !ok || ar.Name() != name {
+				continue
+			}
+			for _, a := range ar.ActiveAlerts() {
+				if a.State == rules.StateFiring {
+					got = append(got, labelAndAnnotation{
+						Labels:      a.Labels.Copy(),
+						Annotations: a.Annotations.Copy(),
+					})
+				}
+			}
+		}
+	}
+	return got
+}
+
+// orderedGroups returns the groups ordered by groupOrder. Groups not listed
+// there are evaluated first.
+func orderedGroups(groupsMap map[string]*rules.Group, groupOrder map[string]int) []*rules.Group {
+	groups := make([]*rules.Group, 0, len(groupsMap))
+	for _, g := range groupsMap {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groupOrder[groups[i].Name()] < groupOrder[groups[j].Name()]
+	})
+	return groups
+}
+
+func shortDuration(d model.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+type labelAndAnnotation struct {
+	Labels      labels.Labels
+	Annotations labels.Labels
+}
+
+func (la labelAndAnnotation) String() string {
+	return "Labels:" + la.Labels.String() + " Annotations:" + la.Annotations.String()
+}
+
+type labelsAndAnnotations []labelAndAnnotation
+
+func (la labelsAndAnnotations) Len() int      { return len(la) }
+func (la labelsAndAnnotations) Swap(i, j int) { la[i], la[j] = la[j], la[i] }
+func (la labelsAndAnnotations) Less(i, j int) bool {
+	if diff := labels.Compare(la[i].Labels, la[j].Labels); diff != 0 {
+		return diff < 0
+	}
+	return labels.Compare(la[i].Annotations, la[j].Annotations) < 0
+}
+
+func (la labelsAndAnnotations) String() string {
+	if len(la) == 0 {
+		return "[]"
+	}
+	s := make([]string, 0, len(la))
+	for i, a := range la {
+		s = append(s, fmt.Sprintf("\n            %d: %s", i, a))
+	}
+	return "[" + strings.Join(s, ",") + "\n        ]"
+}
+
+type parsedSample struct {
+	Labels labels.Labels
+	Value  float64
+}
+
+func (ps parsedSample) String() string {
+	return ps.Labels.String() + " " + strconv.FormatFloat(ps.Value, 'E', -1, 64)
+}
+
+type samples []parsedSample
+
+func (s samples) Len() int           { return len(s) }
+func (s samples) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s samples) Less(i, j int) bool { return labels.Compare(s[i].Labels, s[j].Labels) < 0 }
+
+func (s samples) String() string {
+	if len(s) == 0 {
+		return "nil"
+	}
+	parts := make([]string, 0, len(s))
+	for _, ps := range s {
+		parts = append(parts, ps.String())
+	}
+	return strings.Join(parts, ", ")
+}
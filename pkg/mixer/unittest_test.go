@@ -0,0 +1,239 @@
+// Copyright 2022 mixtool authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testUnitMixin = `
+{
+  prometheusRules+:: {
+    groups+: [
+      {
+        name: 'test-rules',
+        rules: [
+          {
+            record: 'job:up:sum',
+            expr: 'sum by (job) (up)',
+          },
+        ],
+      },
+    ],
+  },
+  prometheusAlerts+:: {
+    groups+: [
+      {
+        name: 'test-alerts',
+        rules: [
+          {
+            alert: 'InstanceDown',
+            expr: 'up == 0',
+            'for': '5m',
+            labels: { severity: 'critical' },
+            annotations: { summary: '{{ $labels.instance }} is down' },
+          },
+        ],
+      },
+    ],
+  },
+}
+`
+
+const testUnitPassing = `
+tests:
+  - interval: 1m
+    input_series:
+      - series: 'up{job="node", instance="a"}'
+        values: '1 1 0 0 0 0 0 0 0 0'
+      - series: 'up{job="node", instance="b"}'
+        values: '1x10'
+    promql_expr_test:
+      - expr: job:up:sum
+        eval_time: 1m
+        exp_samples:
+          - labels: 'job:up:sum{job="node"}'
+            value: 2
+    alert_rule_test:
+      - eval_time: 4m
+        alertname: InstanceDown
+      - eval_time: 8m
+        alertname: InstanceDown
+        exp_alerts:
+          - exp_labels:
+              severity: critical
+              job: node
+              instance: a
+            exp_annotations:
+              summary: a is down
+`
+
+const testUnitFailing = `
+tests:
+  - name: wrong expectations
+    interval: 1m
+    input_series:
+      - series: 'up{job="node", instance="a"}'
+        values: '1x10'
+    promql_expr_test:
+      - expr: job:up:sum
+        eval_time: 1m
+        exp_samples:
+          - labels: 'job:up:sum{job="node"}'
+            value: 2
+    alert_rule_test:
+      - eval_time: 8m
+        alertname: InstanceDown
+        exp_alerts:
+          - exp_labels:
+              severity: critical
+              job: node
+              instance: a
+`
+
+func TestUnitTestPasses(t *testing.T) {
+	filename, delete := writeTempFile(t, "mixin.jsonnet", testUnitMixin)
+	defer delete()
+	testFile, deleteTest := writeTempFile(t, "test.yaml", testUnitPassing)
+	defer deleteTest()
+
+	var out bytes.Buffer
+	if err := Test(&out, filename, []string{testFile}, TestOptions{}); err != nil {
+		t.Errorf("unexpected test failure: %v\n%s", err, out.String())
+	}
+}
+
+func TestUnitTestFails(t *testing.T) {
+	filename, delete := writeTempFile(t, "mixin.jsonnet", testUnitMixin)
+	defer delete()
+	testFile, deleteTest := writeTempFile(t, "test.yaml", testUnitFailing)
+	defer deleteTest()
+
+	var out bytes.Buffer
+	if err := Test(&out, filename, []string{testFile}, TestOptions{}); err == nil {
+		t.Errorf("expected test failure, got none:\n%s", out.String())
+	}
+
+	for _, expected := range []string{"FAILED", `expr: "job:up:sum"`, "alertname: InstanceDown"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestUnitTestUnknownField(t *testing.T) {
+	filename, delete := writeTempFile(t, "mixin.jsonnet", testUnitMixin)
+	defer delete()
+	testFile, deleteTest := writeTempFile(t, "test.yaml", "tests: []\nunknown: true\n")
+	defer deleteTest()
+
+	var out bytes.Buffer
+	if err := Test(&out, filename, []string{testFile}, TestOptions{}); err == nil {
+		t.Errorf("expected unknown field to fail the test file:\n%s", out.String())
+	}
+}
+
+const testUnitLokiMixin = `
+{
+  lokiRules+:: {
+    groups+: [
+      {
+        name: 'test-rules',
+        rules: [
+          {
+            record: 'job:log_lines:rate1m',
+            expr: 'sum by (job) (rate({job=~".+"}[1m]))',
+          },
+        ],
+      },
+    ],
+  },
+  lokiAlerts+:: {
+    groups+: [
+      {
+        name: 'test-alerts',
+        rules: [
+          {
+            alert: 'ManyErrors',
+            expr: 'sum by (job) (count_over_time({job="app"} |= "error" [5m])) > 3',
+            'for': '2m',
+            labels: { severity: 'warning' },
+            annotations: { summary: '{{ $labels.job }} logs errors' },
+          },
+        ],
+      },
+    ],
+  },
+}
+`
+
+const testUnitLokiPassing = `
+tests:
+  - interval: 1m
+    input_streams:
+      - stream: '{job="app", pod="a"}'
+        entries:
+          - ts: 0m
+            line: 'level=info msg="started"'
+          - ts: 1m
+            line: 'level=error msg="request failed"'
+            repeat: 9
+    logql_expr_test:
+      - expr: 'sum(count_over_time({job="app"} |= "error" [5m]))'
+        eval_time: 5m
+        exp_samples:
+          - labels: '{}'
+            value: 5
+    alert_rule_test:
+      - eval_time: 4m
+        alertname: ManyErrors
+      - eval_time: 7m
+        alertname: ManyErrors
+        exp_alerts:
+          - exp_labels:
+              severity: warning
+              job: app
+            exp_annotations:
+              summary: app logs errors
+`
+
+func TestUnitTestLokiPasses(t *testing.T) {
+	filename, delete := writeTempFile(t, "mixin.jsonnet", testUnitLokiMixin)
+	defer delete()
+	testFile, deleteTest := writeTempFile(t, "test.yaml", testUnitLokiPassing)
+	defer deleteTest()
+
+	var out bytes.Buffer
+	if err := Test(&out, filename, []string{testFile}, TestOptions{DataSource: Loki}); err != nil {
+		t.Errorf("unexpected test failure: %v\n%s", err, out.String())
+	}
+}
+
+func TestUnitTestLokiFails(t *testing.T) {
+	filename, delete := writeTempFile(t, "mixin.jsonnet", testUnitLokiMixin)
+	defer delete()
+	testFile, deleteTest := writeTempFile(t, "test.yaml", strings.Replace(testUnitLokiPassing, "eval_time: 7m", "eval_time: 5m", 1))
+	defer deleteTest()
+
+	var out bytes.Buffer
+	if err := Test(&out, filename, []string{testFile}, TestOptions{DataSource: Loki}); err == nil {
+		t.Errorf("expected test failure, got none:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "alertname: ManyErrors") {
+		t.Errorf("expected output to report ManyErrors, got:\n%s", out.String())
+	}
+}